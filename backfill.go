@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+// Discord caps a single ChannelMessages request to 100 messages
+const backfillPageSize = 100
+
+// Per-channel progress of the history backfill, persisted so that
+// a restart resumes from where the previous run stopped.
+// Oldest is the cursor used to walk back in history, Newest the one
+// used to catch up with what was posted while the bot was offline.
+type ChannelCheckpoint struct {
+	ChannelID string `gorm:"primaryKey" json:"channel_id"`
+	Oldest    string `json:"oldest,omitempty"`
+	Newest    string `json:"newest,omitempty"`
+	Complete  bool   `json:"complete"`
+	UpdatedAt time.Time
+}
+
+// Walks the whole history of every channel observed in any guild,
+// feeding the attachments found into the same path used by the
+// message handler
+func (bot *memeBot) backfill(ctx context.Context) {
+	var channels []string
+	for _, guild := range bot.guilds.list() {
+		channels = append(channels, bot.guildChannels(guild)...)
+	}
+	for _, channelID := range channels {
+		err := bot.backfillChannel(ctx, channelID)
+		if err != nil {
+			log.Printf("Backfill of channel %s stopped: %v\n", channelID, err)
+			continue
+		}
+		log.Printf("Backfill of channel %s completed\n", channelID)
+	}
+}
+
+// Observed channels still in the guild, a deleted channel would fail
+// the backfill on every start
+func (bot *memeBot) guildChannels(guild *GuildConfig) []string {
+	existing, err := bot.platform.GuildChannels(guild.GuildID)
+	if err != nil {
+		log.Printf("Error listing channels of guild %s\n", guild.GuildID)
+		return guild.ObservedChannels
+	}
+	var channels []string
+	for _, channelID := range guild.ObservedChannels {
+		found := false
+		for _, channel := range existing {
+			found = found || channel.ID == channelID
+		}
+		if !found {
+			log.Printf("Channel %s not found in guild %s, skipping\n", channelID, guild.GuildID)
+			continue
+		}
+		channels = append(channels, channelID)
+	}
+	return channels
+}
+
+func (bot *memeBot) backfillChannel(ctx context.Context, channelID string) error {
+	checkpoint, err := loadCheckpoint(bot.gorm, channelID)
+	if err != nil {
+		return err
+	}
+
+	// Catch up with messages posted after the last run. A channel that
+	// was empty has no newest message, it's caught up from the start.
+	for checkpoint.Newest != "" || checkpoint.Complete {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		after := orDefault(checkpoint.Newest, "0")
+		messages, err := bot.platform.ChannelMessages(channelID, backfillPageSize, "", after)
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			break
+		}
+		sortMessages(messages)
+		for _, message := range messages {
+			bot.backfillMessage(message)
+		}
+		if checkpoint.Oldest == "" {
+			checkpoint.Oldest = messages[0].ID
+		}
+		checkpoint.Newest = messages[len(messages)-1].ID
+		if err := saveCheckpoint(bot.gorm, checkpoint); err != nil {
+			return err
+		}
+		if len(messages) < backfillPageSize {
+			break
+		}
+	}
+
+	// Walk back until the beginning of the channel history
+	for !checkpoint.Complete {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		messages, err := bot.platform.ChannelMessages(channelID, backfillPageSize, checkpoint.Oldest, "")
+		if err != nil {
+			return err
+		}
+		sortMessages(messages)
+		// Newest first, so the oldest cursor always moves back in history
+		for i := len(messages) - 1; i >= 0; i-- {
+			bot.backfillMessage(messages[i])
+		}
+		if len(messages) > 0 {
+			checkpoint.Oldest = messages[0].ID
+			if checkpoint.Newest == "" {
+				checkpoint.Newest = messages[len(messages)-1].ID
+			}
+		}
+		checkpoint.Complete = len(messages) < backfillPageSize
+		if err := saveCheckpoint(bot.gorm, checkpoint); err != nil {
+			return err
+		}
+		log.Printf("Backfilled %d messages from channel %s\n", len(messages), channelID)
+	}
+	return nil
+}
+
+func (bot *memeBot) backfillMessage(message *discordgo.Message) {
+	if bot.ingestMessage(message, false) {
+		bot.reconcileVotes(message)
+	}
+}
+
+func loadCheckpoint(db *gorm.DB, channelID string) (*ChannelCheckpoint, error) {
+	checkpoint := &ChannelCheckpoint{ChannelID: channelID}
+	tx := db.Where(&ChannelCheckpoint{ChannelID: channelID}).FirstOrInit(checkpoint)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return checkpoint, nil
+}
+
+func saveCheckpoint(db *gorm.DB, checkpoint *ChannelCheckpoint) error {
+	return db.Save(checkpoint).Error
+}
+
+// Sorts messages from the oldest to the newest
+func sortMessages(messages []*discordgo.Message) {
+	sort.Slice(messages, func(i, j int) bool {
+		return snowflakeLess(messages[i].ID, messages[j].ID)
+	})
+}
+
+// Snowflakes are numeric strings, a shorter one is always older
+func snowflakeLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Snowflake like IDs, growing with i
+func backfillID(i int) string {
+	return fmt.Sprint(1000000 + i)
+}
+
+// Posts messages from to to (included) while the bot is offline, the
+// ones in withMedia carry an attachment
+func postHistory(fake *fakePlatform, media *mediaServer, channelID string, from int, to int, withMedia ...int) {
+	for i := from; i <= to; i++ {
+		message := testMessage(channelID, backfillID(i), fmt.Sprintf("message %d", i))
+		for _, m := range withMedia {
+			if m == i {
+				message.Attachments = append(message.Attachments, media.add(fmt.Sprintf("%s-%d.png", channelID, i), testPNG(i)))
+			}
+		}
+		fake.AddMessage(message)
+	}
+}
+
+func checkPages(t *testing.T, fake *fakePlatform, want []fakePage) {
+	t.Helper()
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if !reflect.DeepEqual(fake.Pages, want) {
+		t.Errorf("got pages %+v\nwant %+v", fake.Pages, want)
+	}
+	fake.Pages = nil
+}
+
+func checkCheckpoint(t *testing.T, bot *memeBot, channelID string, oldest string, newest string, complete bool) {
+	t.Helper()
+	checkpoint, err := loadCheckpoint(bot.gorm, channelID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.Oldest != oldest || checkpoint.Newest != newest || checkpoint.Complete != complete {
+		t.Errorf("got checkpoint %+v, want oldest %s, newest %s, complete %v", checkpoint, oldest, newest, complete)
+	}
+}
+
+func TestBackfillChannel(t *testing.T) {
+	bot, fake := newTestBot(t)
+	media := newMediaServer(t)
+	ctx := context.Background()
+
+	postHistory(fake, media, testChannel, 1, 250, 10, 200)
+	if err := bot.backfillChannel(ctx, testChannel); err != nil {
+		t.Fatal(err)
+	}
+	// From the latest back, until a page isn't full
+	checkPages(t, fake, []fakePage{
+		{ChannelID: testChannel},
+		{ChannelID: testChannel, Before: backfillID(151)},
+		{ChannelID: testChannel, Before: backfillID(51)},
+	})
+	checkCheckpoint(t, bot, testChannel, backfillID(1), backfillID(250), true)
+	waitForFiles(t, bot.gorm, 2)
+
+	// Posted while offline, caught up from the newest seen
+	postHistory(fake, media, testChannel, 251, 370, 300)
+	if err := bot.backfillChannel(ctx, testChannel); err != nil {
+		t.Fatal(err)
+	}
+	checkPages(t, fake, []fakePage{
+		{ChannelID: testChannel, After: backfillID(250)},
+		{ChannelID: testChannel, After: backfillID(350)},
+	})
+	checkCheckpoint(t, bot, testChannel, backfillID(1), backfillID(370), true)
+	waitForFiles(t, bot.gorm, 3)
+
+	// Nothing new, nothing downloaded twice
+	if err := bot.backfillChannel(ctx, testChannel); err != nil {
+		t.Fatal(err)
+	}
+	checkPages(t, fake, []fakePage{{ChannelID: testChannel, After: backfillID(370)}})
+	for _, i := range []int{10, 200, 300} {
+		if n := media.downloads(fmt.Sprintf("%s-%d.png", testChannel, i)); n != 1 {
+			t.Errorf("%d.png downloaded %d times, want 1", i, n)
+		}
+	}
+}
+
+// A run stopped halfway resumes walking back from the oldest message
+// it reached
+func TestBackfillChannelResumes(t *testing.T) {
+	bot, fake := newTestBot(t)
+	media := newMediaServer(t)
+
+	postHistory(fake, media, testChannel, 1, 250, 10, 200)
+	err := saveCheckpoint(bot.gorm, &ChannelCheckpoint{ChannelID: testChannel, Oldest: backfillID(101), Newest: backfillID(250)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bot.backfillChannel(context.Background(), testChannel); err != nil {
+		t.Fatal(err)
+	}
+	checkPages(t, fake, []fakePage{
+		{ChannelID: testChannel, After: backfillID(250)},
+		{ChannelID: testChannel, Before: backfillID(101)},
+		{ChannelID: testChannel, Before: backfillID(1)},
+	})
+	checkCheckpoint(t, bot, testChannel, backfillID(1), backfillID(250), true)
+
+	waitForFiles(t, bot.gorm, 1)
+	var files []*FileInfo
+	if err := bot.gorm.Find(&files).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].MessageID != backfillID(10) {
+		t.Errorf("got %d files, want only the one of message %s", len(files), backfillID(10))
+	}
+	if n := media.downloads(testChannel + "-200.png"); n != 0 {
+		t.Errorf("200.png, already walked past, downloaded %d times", n)
+	}
+
+	// Empty on the first run, later posts are caught up from the start
+	if err := bot.backfillChannel(context.Background(), testEmptyChannel); err != nil {
+		t.Fatal(err)
+	}
+	checkPages(t, fake, []fakePage{{ChannelID: testEmptyChannel}})
+	checkCheckpoint(t, bot, testEmptyChannel, "", "", true)
+
+	postHistory(fake, media, testEmptyChannel, 1, 3, 2)
+	if err := bot.backfillChannel(context.Background(), testEmptyChannel); err != nil {
+		t.Fatal(err)
+	}
+	checkPages(t, fake, []fakePage{{ChannelID: testEmptyChannel, After: "0"}})
+	checkCheckpoint(t, bot, testEmptyChannel, backfillID(1), backfillID(3), true)
+	waitForFiles(t, bot.gorm, 2)
+}
+
+// Channels removed from the guild are skipped
+func TestGuildChannels(t *testing.T) {
+	fake := newFakePlatform("1")
+	fake.AddChannel(testGuild, &discordgo.Channel{ID: testChannel, Name: "cat-memes"})
+	fake.AddChannel(testGuild, &discordgo.Channel{ID: "101", Name: "dog-memes"})
+	bot := &memeBot{platform: fake}
+	guild := &GuildConfig{GuildID: testGuild, ObservedChannels: []string{testChannel, "101", "102"}}
+	got := bot.guildChannels(guild)
+	if !reflect.DeepEqual(got, []string{testChannel, "101"}) {
+		t.Errorf("got channels %v", got)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"gorm.io/gorm"
+)
+
+// Items accepted by a single bulk request
+const bulkMaxItems = 500
+
+const (
+	bulkApprove = "approve"
+	bulkReject  = "reject"
+	bulkTag     = "tag"
+	// Hides the file from the archive, admins only. The stored file is
+	// kept, like for the messages deleted from Discord.
+	bulkDelete = "delete"
+)
+
+var (
+	errBulkInvalid   = errors.New("invalid item")
+	errBulkForbidden = errors.New("admins only")
+)
+
+type bulkRequest struct {
+	Items []*bulkItem `json:"items"`
+}
+
+type bulkItem struct {
+	ID     int    `json:"id"`
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"`
+	// Tags added and removed by the tag action
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+}
+
+// Outcome of an item, with the status the single item endpoint would
+// have answered
+type bulkResult struct {
+	ID     int    `json:"id"`
+	Action string `json:"action"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Applies the items in a single transaction. Each item runs in its own
+// savepoint, so a failed one is rolled back alone and the others are
+// committed together.
+func applyBulk(db *gorm.DB, policy reviewPolicy, by reviewer, items []*bulkItem) ([]*bulkResult, error) {
+	results := make([]*bulkResult, len(items))
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for i, item := range items {
+			err := tx.Transaction(func(tx *gorm.DB) error {
+				return applyBulkItem(tx, policy, by, item)
+			})
+			results[i] = bulkItemResult(item, err)
+			if results[i].Status == http.StatusInternalServerError {
+				// Not the item's fault, the transaction is likely gone
+				return err
+			}
+		}
+		return nil
+	})
+	return results, err
+}
+
+func applyBulkItem(tx *gorm.DB, policy reviewPolicy, by reviewer, item *bulkItem) error {
+	switch item.Action {
+	case bulkApprove, bulkReject:
+		return reviewFile(tx, policy, item.ID, item.Action == bulkApprove, by, item.Reason)
+	case bulkTag:
+		if len(normalizeTags(item.Add))+len(normalizeTags(item.Remove)) == 0 {
+			return fmt.Errorf("%w: no tags to add or remove", errBulkInvalid)
+		}
+		if _, err := lockFile(tx, item.ID); err != nil {
+			return err
+		}
+		if err := removeTags(tx, []int{item.ID}, item.Remove); err != nil {
+			return err
+		}
+		return addTags(tx, []int{item.ID}, item.Add)
+	case bulkDelete:
+		if !by.admin {
+			return errBulkForbidden
+		}
+		if _, err := lockFile(tx, item.ID); err != nil {
+			return err
+		}
+		return tx.Model(&FileInfo{}).Where("id = ?", item.ID).
+			Updates(map[string]interface{}{"hidden": true, "claimed_by": 0, "claim_expires": nil}).Error
+	default:
+		return fmt.Errorf("%w: unknown action %q", errBulkInvalid, item.Action)
+	}
+}
+
+func bulkItemResult(item *bulkItem, err error) *bulkResult {
+	result := &bulkResult{ID: item.ID, Action: item.Action, Status: http.StatusOK}
+	switch {
+	case err == nil:
+		return result
+	case errors.Is(err, errBulkInvalid):
+		result.Status = http.StatusBadRequest
+	case errors.Is(err, errBulkForbidden):
+		result.Status = http.StatusForbidden
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		result.Status, err = http.StatusNotFound, errors.New("not found")
+	case errors.Is(err, errClaimed):
+		result.Status = http.StatusConflict
+	default:
+		result.Status, err = http.StatusInternalServerError, errors.New("internal error")
+	}
+	result.Error = err.Error()
+	return result
+}
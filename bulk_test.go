@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestBulkItemResult(t *testing.T) {
+	tests := []struct {
+		err     error
+		status  int
+		message string
+	}{
+		{err: nil, status: http.StatusOK},
+		{err: fmt.Errorf("%w: unknown action %q", errBulkInvalid, "burn"), status: http.StatusBadRequest, message: `invalid item: unknown action "burn"`},
+		{err: errBulkForbidden, status: http.StatusForbidden, message: "admins only"},
+		{err: gorm.ErrRecordNotFound, status: http.StatusNotFound, message: "not found"},
+		{err: fmt.Errorf("locking: %w", gorm.ErrRecordNotFound), status: http.StatusNotFound, message: "not found"},
+		{err: errClaimed, status: http.StatusConflict, message: errClaimed.Error()},
+		// Database errors aren't shown
+		{err: errors.New(`pq: relation "file_infos" does not exist`), status: http.StatusInternalServerError, message: "internal error"},
+	}
+	for _, test := range tests {
+		result := bulkItemResult(&bulkItem{ID: 7, Action: bulkApprove}, test.err)
+		if result.ID != 7 || result.Action != bulkApprove || result.Status != test.status || result.Error != test.message {
+			t.Errorf("%v: got %+v", test.err, result)
+		}
+	}
+}
+
+func TestApplyBulk(t *testing.T) {
+	db := testDB(t)
+	files := createPending(t, db, 4)
+	policy := reviewPolicy{name: policySingle, undoWindow: defaultUndoWindow}
+	moderator := reviewer{userID: 1, source: sourceWeb}
+	admin := reviewer{userID: 2, source: sourceWeb, admin: true}
+	// Held by another moderator
+	db.Model(&FileInfo{}).Where("id = ?", files[3].ID).
+		Updates(map[string]interface{}{"claimed_by": 3, "claim_expires": time.Now().Add(time.Hour)})
+
+	items := []*bulkItem{
+		{ID: files[0].ID, Action: bulkApprove},
+		{ID: files[1].ID, Action: bulkTag},
+		{ID: 999999, Action: bulkReject},
+		{ID: files[2].ID, Action: bulkDelete},
+		{ID: files[2].ID, Action: bulkTag, Add: []string{"Cat"}},
+		{ID: files[3].ID, Action: bulkReject, Reason: "old"},
+		{ID: files[1].ID, Action: "burn"},
+		{ID: files[1].ID, Action: bulkReject, Reason: "not funny"},
+	}
+	results, err := applyBulk(db, policy, moderator, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{http.StatusOK, http.StatusBadRequest, http.StatusNotFound, http.StatusForbidden, http.StatusOK, http.StatusConflict, http.StatusBadRequest, http.StatusOK}
+	for i, result := range results {
+		if result.ID != items[i].ID || result.Status != want[i] {
+			t.Errorf("item %d: got %+v, want status %d", i, result, want[i])
+		}
+	}
+
+	// The failed items changed nothing, the others are committed
+	if file := loadFile(t, db, files[0].ID); !file.Reviewed || !file.Approved {
+		t.Errorf("file 0 not approved")
+	}
+	if file := loadFile(t, db, files[1].ID); !file.Reviewed || file.Approved {
+		t.Errorf("file 1 not rejected")
+	}
+	if file := loadFile(t, db, files[2].ID); file.Hidden {
+		t.Errorf("file 2 deleted by a moderator")
+	}
+	if tags, _ := fileTags(db, files[2].ID); len(tags) != 1 || tags[0].Name != "cat" {
+		t.Errorf("file 2 tagged %v", tags)
+	}
+	if file := loadFile(t, db, files[3].ID); file.Reviewed || file.ClaimedBy != 3 {
+		t.Errorf("claimed file changed: reviewed %v, claimed by %d", file.Reviewed, file.ClaimedBy)
+	}
+	if events, _ := reviewHistory(db, files[3].ID); len(events) != 0 {
+		t.Errorf("got %d events on the claimed file", len(events))
+	}
+
+	// Admins can delete, claimed or not
+	results, err = applyBulk(db, policy, admin, []*bulkItem{
+		{ID: files[2].ID, Action: bulkDelete},
+		{ID: files[3].ID, Action: bulkDelete},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result.Status != http.StatusOK {
+			t.Errorf("admin delete %d: got %+v", i, result)
+		}
+	}
+	for _, file := range files[2:] {
+		if file := loadFile(t, db, file.ID); !file.Hidden || file.ClaimedBy != 0 {
+			t.Errorf("file %d not deleted: hidden %v, claimed by %d", file.ID, file.Hidden, file.ClaimedBy)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package cattp
 import (
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/rs/cors"
 	"golang.org/x/net/http2"
@@ -53,7 +54,6 @@ func New[T any](context T) *Router[T] {
 	//TODO:     ..filepath.join with "provided_dir" + "found dir name"  )
 	router.Mux.Handle("/css/", http.StripPrefix("/css/", http.FileServer(http.Dir("static/css"))))
 	router.Mux.Handle("/js/", http.StripPrefix("/js/", http.FileServer(http.Dir("static/js"))))
-	router.Mux.Handle("/img/", http.StripPrefix("/img/", http.FileServer(http.Dir("img"))))
 
 	router.Mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/" {
@@ -119,6 +119,17 @@ func (router *Router[T]) Listen(conf *Config) error {
 	return err
 }
 
+// Splits what follows the prefix of the request path, the ServeMux
+// only matches fixed patterns so "/saved/" + "{id}" are parsed here.
+// eg: PathSegments(r, "/img/thumb/") on "/img/thumb/12" is ["12"]
+func PathSegments(r *http.Request, prefix string) []string {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if rest == "" {
+		return nil
+	}
+	return strings.Split(rest, "/")
+}
+
 // Allows the Router to behave as Handler for incoming HTTP Requests by
 // wrapping the it's internal Mux Handler, acting as middleware.
 func (router *Router[T]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
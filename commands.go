@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/exp/slices"
+	"gorm.io/gorm"
+)
+
+// Results listed by "/meme search"
+const searchResultsLimit = 10
+
+var memeCommand = &discordgo.ApplicationCommand{
+	Name:        "meme",
+	Description: "Browse and moderate the meme archive",
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "random",
+			Description: "Post a random approved meme",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "search",
+			Description: "Find memes by tag",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "tag",
+					Description: "Tag to look for",
+					Required:    true,
+				},
+			},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "stats",
+			Description: "Show archive statistics",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "approve",
+			Description: "Approve a saved meme (moderators only)",
+			Options:     []*discordgo.ApplicationCommandOption{fileIDOption, reasonOption},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "reject",
+			Description: "Reject a saved meme (moderators only)",
+			Options:     []*discordgo.ApplicationCommandOption{fileIDOption, reasonOption},
+		},
+	},
+}
+
+var fileIDOption = &discordgo.ApplicationCommandOption{
+	Type:        discordgo.ApplicationCommandOptionInteger,
+	Name:        "id",
+	Description: "ID of the saved meme",
+	Required:    true,
+	MinValue:    func() *float64 { v := 1.0; return &v }(),
+}
+
+var reasonOption = &discordgo.ApplicationCommandOption{
+	Type:        discordgo.ApplicationCommandOptionString,
+	Name:        "reason",
+	Description: "Why, kept in the review history",
+	MaxLength:   maxReasonLength,
+}
+
+// Registers the commands on the guilds added to the configuration, guild
+// commands are available right away while global ones take up to an
+// hour to propagate
+func (bot *memeBot) registerCommands(guilds []*GuildConfig) {
+	for _, guild := range guilds {
+		err := bot.platform.RegisterCommands(guild.GuildID, []*discordgo.ApplicationCommand{memeCommand})
+		if err != nil {
+			log.Printf("Error registering slash commands on guild %s: %v\n", guild.GuildID, err)
+		}
+	}
+}
+
+func (bot *memeBot) interactionHandler(interaction *discordgo.InteractionCreate) {
+	if interaction.Type != discordgo.InteractionApplicationCommand {
+		return
+	}
+	data := interaction.ApplicationCommandData()
+	if data.Name != memeCommand.Name || len(data.Options) == 0 {
+		return
+	}
+
+	sub := data.Options[0]
+	var response *discordgo.InteractionResponseData
+	switch sub.Name {
+	case "random":
+		response = bot.randomCommand()
+	case "search":
+		response = bot.searchCommand(sub.Options[0].StringValue())
+	case "stats":
+		response = bot.statsCommand()
+	case "approve", "reject":
+		if !bot.isModerator(interaction.Member, interaction.GuildID, interaction.ChannelID) {
+			response = ephemeral("Only moderators can review memes.")
+			break
+		}
+		var reason string
+		if len(sub.Options) > 1 {
+			reason = sub.Options[1].StringValue()
+		}
+		response = bot.reviewCommand(interaction.Member, int(sub.Options[0].IntValue()), sub.Name == "approve", reason)
+	default:
+		return
+	}
+
+	err := bot.platform.RespondInteraction(interaction.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: response,
+	})
+	if err != nil {
+		log.Printf("Error responding to /meme %s: %v\n", sub.Name, err)
+	}
+}
+
+// Members with the role configured for the guild, or allowed to
+// manage messages when no role is configured
+// The guild is taken from the event, Discord doesn't set it on members
+func (bot *memeBot) isModerator(member *discordgo.Member, guildID string, channelID string) bool {
+	if member == nil {
+		return false
+	}
+	guild := bot.guilds.forGuild(guildID)
+	if guild == nil {
+		guild = bot.guilds.forChannel(channelID)
+	}
+	if guild != nil && guild.ModeratorRole != "" {
+		return slices.Contains(member.Roles, guild.ModeratorRole)
+	}
+	// Only interactions carry the permissions, events need the state
+	permissions := member.Permissions
+	if permissions == 0 && member.User != nil {
+		permissions, _ = bot.platform.ChannelPermissions(member.User.ID, channelID)
+	}
+	return permissions&discordgo.PermissionManageMessages != 0
+}
+
+func (bot *memeBot) randomCommand() *discordgo.InteractionResponseData {
+	var file FileInfo
+	tx := bot.gorm.
+		Where("approved = ? AND hidden = ? AND path <> ''", true, false).
+		Order("random()").
+		Limit(1).
+		Find(&file)
+	if tx.Error != nil {
+		log.Println("Error getting random meme")
+		return ephemeral("Something went wrong, try again later.")
+	}
+	if tx.RowsAffected < 1 {
+		return ephemeral("No approved memes yet.")
+	}
+
+	content, err := bot.readFile(file.Path)
+	if err != nil {
+		log.Printf("Can't read file ID %d from storage\n", file.ID)
+		return ephemeral("Something went wrong, try again later.")
+	}
+	return &discordgo.InteractionResponseData{
+		Content: fmt.Sprintf("#%d %s", file.ID, sourceLink(&file)),
+		Files: []*discordgo.File{{
+			Name:        "meme" + path.Ext(file.Path),
+			ContentType: file.MimeType,
+			Reader:      bytes.NewReader(content),
+		}},
+	}
+}
+
+func (bot *memeBot) searchCommand(tag string) *discordgo.InteractionResponseData {
+	files, err := searchFiles(bot.gorm, tag, searchResultsLimit)
+	if err != nil {
+		log.Println("Error searching memes")
+		return ephemeral("Something went wrong, try again later.")
+	}
+	if len(files) == 0 {
+		return ephemeral(fmt.Sprintf("No memes found for %q.", tag))
+	}
+
+	var lines []string
+	for _, file := range files {
+		lines = append(lines, fmt.Sprintf("`#%d` %s %s", file.ID, file.FileName, sourceLink(file)))
+	}
+	return &discordgo.InteractionResponseData{Content: strings.Join(lines, "\n")}
+}
+
+func (bot *memeBot) statsCommand() *discordgo.InteractionResponseData {
+	stats, err := getArchiveStats(bot.gorm)
+	if err != nil {
+		log.Println("Error getting archive stats")
+		return ephemeral("Something went wrong, try again later.")
+	}
+	return &discordgo.InteractionResponseData{
+		Content: fmt.Sprintf(
+			"Saved: %d\nReviewed: %d\nApproved: %d\nRejected: %d\nReposts: %d",
+			stats.Total, stats.Reviewed, stats.Approved, stats.Reviewed-stats.Approved, stats.Reposts,
+		),
+	}
+}
+
+func (bot *memeBot) reviewCommand(member *discordgo.Member, id int, approved bool, reason string) *discordgo.InteractionResponseData {
+	err := reviewFile(bot.gorm, bot.conf.review, id, approved, reviewer{discordID: member.User.ID, source: sourceDiscord}, reason)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ephemeral(fmt.Sprintf("Meme #%d not found.", id))
+	}
+	if errors.Is(err, errClaimed) {
+		return ephemeral(fmt.Sprintf("Meme #%d is being reviewed on the web app, try again later.", id))
+	}
+	if err != nil {
+		log.Println("Error reviewing file")
+		return ephemeral("Something went wrong, try again later.")
+	}
+	log.Printf("Reviewed post %d from Discord\n", id)
+	bot.fileReviewed(id)
+
+	var file FileInfo
+	tx := bot.gorm.Select("reviewed", "approved", "approvals", "rejections").Limit(1).Find(&file, id)
+	if tx.Error != nil || tx.RowsAffected < 1 {
+		return ephemeral(fmt.Sprintf("Vote on meme #%d recorded.", id))
+	}
+	if !file.Reviewed {
+		// The policy needs more reviewers
+		return ephemeral(fmt.Sprintf(
+			"Vote on meme #%d recorded, %d approvals and %d rejections so far.",
+			id, file.Approvals, file.Rejections,
+		))
+	}
+	decision := "rejected"
+	if file.Approved {
+		decision = "approved"
+	}
+	return ephemeral(fmt.Sprintf("Meme #%d %s.", id, decision))
+}
+
+func ephemeral(content string) *discordgo.InteractionResponseData {
+	return &discordgo.InteractionResponseData{
+		Content: content,
+		Flags:   discordgo.MessageFlagsEphemeral,
+	}
+}
+
+// Link to the message the file was saved from, if it's known
+func sourceLink(file *FileInfo) string {
+	if file.ChannelID == "" || file.MessageID == "" {
+		return ""
+	}
+	switch file.Platform {
+	case platformTelegram:
+		// Only supergroups and channels have links, their IDs start with -100
+		if !strings.HasPrefix(file.ChannelID, "-100") {
+			return ""
+		}
+		return fmt.Sprintf("https://t.me/c/%s/%s", strings.TrimPrefix(file.ChannelID, "-100"), file.MessageID)
+	}
+	if file.GuildID == "" {
+		return ""
+	}
+	return fmt.Sprintf("https://discord.com/channels/%s/%s/%s", file.GuildID, file.ChannelID, file.MessageID)
+}
+
+type archiveStats struct {
+	Total    int64 `json:"total"`
+	Reviewed int64 `json:"reviewed"`
+	Approved int64 `json:"approved"`
+	Reposts  int64 `json:"reposts"`
+}
+
+func getArchiveStats(db *gorm.DB) (*archiveStats, error) {
+	var stats archiveStats
+	tx := db.Model(&FileInfo{}).
+		Select(`COUNT(*) AS total,
+			COUNT(*) FILTER (WHERE reviewed) AS reviewed,
+			COUNT(*) FILTER (WHERE approved) AS approved`).
+		Where("hidden = ?", false).
+		Scan(&stats)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	tx = db.Model(&Repost{}).Count(&stats.Reposts)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return &stats, nil
+}
+
+// Files with a tag starting with the term
+func searchFiles(db *gorm.DB, term string, limit int) ([]*FileInfo, error) {
+	var files []*FileInfo
+	tx := db.
+		Where("hidden = ?", false).
+		Where(`id IN (SELECT file_tags.file_info_id FROM file_tags
+			JOIN tags ON tags.id = file_tags.tag_id
+			WHERE tags.name LIKE ?)`, escapeLike(normalizeTag(term))+"%").
+		Order("id DESC").
+		Limit(limit).
+		Find(&files)
+	return files, tx.Error
+}
+
+func escapeLike(term string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(term)
+}
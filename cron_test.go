@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * *",
+		"* * * * * *",
+		"@yearly",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"1- * * * *",
+		"1,,2 * * * *",
+		"a * * * *",
+		"-1 * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("%q: no error", expr)
+		}
+	}
+}
+
+func TestParseCronFields(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		want     []int
+	}{
+		{"*", 0, 5, []int{0, 1, 2, 3, 4, 5}},
+		{"*/2", 0, 5, []int{0, 2, 4}},
+		{"3", 0, 5, []int{3}},
+		{"1-3", 0, 5, []int{1, 2, 3}},
+		{"1-5/2", 0, 5, []int{1, 3, 5}},
+		{"2/2", 0, 7, []int{2, 4, 6}},
+		{"0,3-4,5", 0, 5, []int{0, 3, 4, 5}},
+		{"*/7", 1, 31, []int{1, 8, 15, 22, 29}},
+	}
+	for _, test := range tests {
+		set, err := parseCronField(test.field, test.min, test.max)
+		if err != nil {
+			t.Errorf("%q: %v", test.field, err)
+			continue
+		}
+		var want uint64
+		for _, v := range test.want {
+			want |= 1 << v
+		}
+		if set != want {
+			t.Errorf("%q: got %b, want %b", test.field, set, want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		parsed, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	tests := []struct {
+		name string
+		expr string
+		from string
+		want string
+	}{
+		{"strictly after", "0 12 * * *", "2023-03-01 12:00", "2023-03-02 12:00"},
+		{"minute step", "*/15 * * * *", "2023-03-01 12:07", "2023-03-01 12:15"},
+		{"hour step", "0 */6 * * *", "2023-03-01 13:00", "2023-03-01 18:00"},
+		{"range with step", "30 9-17/4 * * *", "2023-03-01 13:31", "2023-03-01 17:30"},
+		{"list", "0 12 * * 1,3,5", "2023-03-04 12:00", "2023-03-06 12:00"},
+		{"sunday as 7", "0 0 * * 7", "2023-03-01 10:00", "2023-03-05 00:00"},
+		{"hourly", "@hourly", "2023-03-01 10:30", "2023-03-01 11:00"},
+		{"daily", "@daily", "2023-03-01 10:00", "2023-03-02 00:00"},
+		{"weekly", "@weekly", "2023-03-01 10:00", "2023-03-05 00:00"},
+		{"monthly", "@monthly", "2023-03-15 10:00", "2023-04-01 00:00"},
+		{"year rollover", "0 0 1 * *", "2023-12-15 10:00", "2024-01-01 00:00"},
+		{"short month skipped", "0 0 31 * *", "2023-04-01 00:00", "2023-05-31 00:00"},
+		{"leap day", "0 0 29 2 *", "2023-03-01 00:00", "2024-02-29 00:00"},
+		{"month list", "0 0 1 1,7 *", "2023-03-01 00:00", "2023-07-01 00:00"},
+		// Both day fields restricted, either one matches
+		{"day of week or month", "0 0 13 * 5", "2023-03-01 00:00", "2023-03-03 00:00"},
+		{"day of month or week", "0 0 13 * 5", "2023-03-10 00:00", "2023-03-13 00:00"},
+		{"day of month only", "0 0 13 * *", "2023-03-01 00:00", "2023-03-13 00:00"},
+		// A starred step isn't a restriction, both have to match: the
+		// first Monday on an odd day
+		{"starred step and day of week", "0 0 */2 * 1", "2023-03-01 00:00", "2023-03-13 00:00"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := parseCron(test.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := schedule.Next(at(test.from)); !got.Equal(at(test.want)) {
+				t.Errorf("%q after %s: got %v, want %s", test.expr, test.from, got, test.want)
+			}
+		})
+	}
+
+	never, err := parseCron("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := never.Next(at("2023-03-01 00:00")); !next.IsZero() {
+		t.Errorf("impossible schedule due at %v", next)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Every further sighting of an already archived file, the original
+// post stays the one referenced by FileInfo
+type Repost struct {
+	ID        int    `gorm:"primaryKey" json:"id"`
+	FileID    int    `gorm:"uniqueIndex:idx_repost_sighting" json:"file_id"`
+	Sender    string `json:"sender"`
+	ChannelID string `json:"channel_id"`
+	MessageID string `gorm:"uniqueIndex:idx_repost_sighting" json:"message_id"`
+	// Which media of the message, a message can carry many
+	FileName  string    `gorm:"uniqueIndex:idx_repost_sighting" json:"file_name,omitempty"`
+	SourceURL string    `gorm:"uniqueIndex:idx_repost_sighting" json:"source_url,omitempty"`
+	Sent      time.Time `json:"sent"`
+}
+
+// Reposts used to be recorded once per message, which hid the other
+// media of the message from alreadyArchived
+func migrateReposts(db *gorm.DB) error {
+	if !db.Migrator().HasIndex(&Repost{}, "idx_repost_message") {
+		return nil
+	}
+	return db.Migrator().DropIndex(&Repost{}, "idx_repost_message")
+}
+
+// Hex encoded SHA-256 of the file content, used as identity of a file
+func contentDigest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the stored file with the same content, nil if there is none
+func findByDigest(db *gorm.DB, digest string) (*FileInfo, error) {
+	if digest == "" {
+		return nil, errors.New("empty digest")
+	}
+	var file FileInfo
+	tx := db.Omit("Content").Where("digest = ?", digest).Order("id").Limit(1).Find(&file)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if tx.RowsAffected < 1 {
+		return nil, nil
+	}
+	return &file, nil
+}
+
+// True when the media was already saved or seen as a repost from this
+// message, so a rescan of the history doesn't download it again and
+// media added to the message by an edit are still picked up
+func alreadyArchived(db *gorm.DB, job *PendingDownload) bool {
+	var count int64
+	tx := db.Model(&FileInfo{}).
+		Where("platform = ? AND channel_id = ? AND message_id = ? AND file_name = ? AND COALESCE(source_url, '') = ?",
+			job.Platform, job.ChannelID, job.MessageID, job.FileName, job.SourceURL).
+		Count(&count)
+	if tx.Error != nil || count > 0 {
+		return count > 0
+	}
+	tx = db.Model(&Repost{}).
+		Where("channel_id = ? AND message_id = ? AND file_name = ? AND COALESCE(source_url, '') = ?",
+			job.ChannelID, job.MessageID, job.FileName, job.SourceURL).
+		Count(&count)
+	return tx.Error == nil && count > 0
+}
+
+// Stores the sighting once per media of a message, so rescanning the
+// same history doesn't inflate the reposts
+func recordRepost(db *gorm.DB, original *FileInfo, file *FileInfo) error {
+	repost := &Repost{
+		FileID:    original.ID,
+		MessageID: file.MessageID,
+		FileName:  file.FileName,
+		SourceURL: file.SourceURL,
+	}
+	var sent time.Time
+	if file.Sent != nil {
+		sent = *file.Sent
+	}
+	// A map keeps the empty names and URLs in the condition
+	tx := db.
+		Where(map[string]interface{}{
+			"file_id":    repost.FileID,
+			"message_id": repost.MessageID,
+			"file_name":  repost.FileName,
+			"source_url": repost.SourceURL,
+		}).
+		Attrs(Repost{Sender: file.Sender, ChannelID: file.ChannelID, Sent: sent}).
+		FirstOrCreate(repost)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected > 0 {
+		log.Printf("File %s is a repost of file ID %d\n", file.FileName, original.ID)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+// A media of a message waiting to be downloaded. Jobs failing all
+// their quick retries are persisted and attempted again later, with
+// growing delays, until maxAttempts is reached.
+type PendingDownload struct {
+	ID       int    `gorm:"primaryKey" json:"id"`
+	Platform string `gorm:"default:discord" json:"platform"`
+	// Telegram keeps the file ID here, see ingestSource.ResolveURL
+	URL          string `json:"url"`
+	SourceURL    string `json:"source_url"`
+	FileName     string `json:"file_name"`
+	DeclaredType string `json:"declared_type"`
+	// Size limit of the guild the media comes from
+	MaxBytes      int64          `json:"max_bytes"`
+	SuggestedTags pq.StringArray `gorm:"type:text[]" json:"suggested_tags"`
+	// Indexed by the search
+	MessageText string    `json:"message_text"`
+	SenderName  string    `json:"sender_name"`
+	Sender      string    `json:"sender"`
+	GuildID     string    `json:"guild_id"`
+	ChannelID   string    `json:"channel_id"`
+	MessageID   string    `json:"message_id"`
+	Sent        time.Time `json:"sent"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `gorm:"index" json:"next_attempt"`
+	LastError   string    `json:"last_error"`
+	CreatedAt   time.Time `json:"created_at"`
+	// Posted while the bot was online, not found by the backfill
+	Live bool `gorm:"-" json:"-"`
+}
+
+type downloaderConf struct {
+	workers int
+	// Time limit of a single HTTP request
+	timeout time.Duration
+	// Attempts made right away before persisting the job
+	retries int
+	// First retry delay, doubled at every attempt
+	backoff time.Duration
+	// Persisted attempts before giving up on a job
+	maxAttempts int
+}
+
+var defaultDownloaderConf = downloaderConf{
+	workers:     4,
+	timeout:     30 * time.Second,
+	retries:     3,
+	backoff:     time.Second,
+	maxAttempts: 10,
+}
+
+// Completion callback of a successful download
+type downloadHandler func(job *PendingDownload, content []byte, mimeType string)
+
+// Gives the URL a job is downloaded from
+type urlResolver func(ctx context.Context, job *PendingDownload) (string, error)
+
+// Bounded pool of workers fetching media, shared by the live handler
+// and the backfill. Shutdown is driven by the context given on
+// creation: jobs in flight or still queued are persisted for the next
+// run. Jobs enqueued before Start wait for the workers.
+type downloader struct {
+	conf    downloaderConf
+	policy  *mediaPolicy
+	db      *gorm.DB
+	handler downloadHandler
+	resolve urlResolver
+	jobs    chan *PendingDownload
+	ctx     context.Context
+	wg      sync.WaitGroup
+}
+
+func newDownloader(ctx context.Context, conf downloaderConf, policy *mediaPolicy, db *gorm.DB, handler downloadHandler, resolve urlResolver) *downloader {
+	return &downloader{
+		ctx:     ctx,
+		conf:    conf,
+		policy:  policy,
+		db:      db,
+		handler: handler,
+		resolve: resolve,
+		jobs:    make(chan *PendingDownload, conf.workers*4),
+	}
+}
+
+func (d *downloader) Start() {
+	for i := 0; i < d.conf.workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+	d.wg.Add(1)
+	go d.retryLoop()
+}
+
+// Waits for the workers to stop after the context is done
+func (d *downloader) Wait() {
+	d.wg.Wait()
+	// A job sent right as the context ended may have missed the workers
+	for {
+		select {
+		case job := <-d.jobs:
+			d.shelve(job)
+		default:
+			return
+		}
+	}
+}
+
+// Blocks until a worker can take the job, so a long backfill doesn't
+// pile up in memory. When shutting down the job is persisted instead.
+func (d *downloader) Enqueue(job *PendingDownload) {
+	// Once shutting down both cases are ready and select picks either
+	if d.ctx.Err() != nil {
+		d.shelve(job)
+		return
+	}
+	select {
+	case d.jobs <- job:
+	case <-d.ctx.Done():
+		d.shelve(job)
+	}
+}
+
+func (d *downloader) work() {
+	defer d.wg.Done()
+	for {
+		select {
+		case job := <-d.jobs:
+			d.run(job)
+		case <-d.ctx.Done():
+			// Nothing gets lost, whatever is left goes to the queue
+			for {
+				select {
+				case job := <-d.jobs:
+					d.shelve(job)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (d *downloader) run(job *PendingDownload) {
+	var err error
+	for attempt := 0; attempt < d.conf.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(d.delay(attempt)):
+			case <-d.ctx.Done():
+				d.shelve(job)
+				return
+			}
+		}
+
+		var content []byte
+		var mimeType string
+		content, mimeType, err = d.fetch(job)
+		if err == nil {
+			d.handler(job, content, mimeType)
+			d.forget(job)
+			return
+		}
+		// Retrying doesn't change what the file is
+		if errors.Is(err, errTooLarge) || errors.Is(err, errTypeNotAllowed) {
+			log.Printf("Rejected %s of message ID %s: %v\n", job.FileName, job.MessageID, err)
+			d.forget(job)
+			return
+		}
+		log.Printf("Download of %s failed (attempt %d): %v\n", job.FileName, attempt+1, err)
+	}
+	// Cut short by the shutdown, not the download's fault
+	if d.ctx.Err() != nil {
+		d.shelve(job)
+		return
+	}
+	d.persist(job, err)
+}
+
+func (d *downloader) fetch(job *PendingDownload) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, d.conf.timeout)
+	defer cancel()
+	policy := *d.policy
+	if job.MaxBytes > 0 {
+		policy.maxBytes = job.MaxBytes
+	}
+	link, err := d.resolve(ctx, job)
+	if err != nil {
+		return nil, "", err
+	}
+	content, mimeType, err := fetchMedia(ctx, link, job.DeclaredType, &policy)
+	// Resolved links may carry credentials, keep them out of the queue
+	var urlErr *url.Error
+	if link != job.URL && errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	return content, mimeType, err
+}
+
+// Exponential delay with some jitter, so failures don't retry in lockstep
+func (d *downloader) delay(attempt int) time.Duration {
+	delay := d.conf.backoff << attempt
+	if delay > time.Hour || delay <= 0 {
+		delay = time.Hour
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Stores the failed job to be retried later. Once out of attempts
+// it's kept with its last error, retryDue doesn't pick it anymore.
+func (d *downloader) persist(job *PendingDownload, cause error) {
+	job.Attempts++
+	if cause != nil {
+		job.LastError = cause.Error()
+	}
+	if job.Attempts >= d.conf.maxAttempts {
+		log.Printf("Giving up on %s of message ID %s after %d attempts\n", job.FileName, job.MessageID, job.Attempts)
+	} else {
+		job.NextAttempt = time.Now().Add(d.delay(job.Attempts + 4))
+	}
+	d.save(job)
+}
+
+// Stores a job the shutdown interrupted, due as soon as the bot is
+// back. It didn't fail, so no attempt is counted.
+func (d *downloader) shelve(job *PendingDownload) {
+	job.NextAttempt = time.Now()
+	d.save(job)
+}
+
+func (d *downloader) save(job *PendingDownload) {
+	tx := d.db.Save(job)
+	if tx.Error != nil {
+		log.Printf("Error persisting download of %s: %v\n", job.FileName, tx.Error)
+	}
+}
+
+// Drops a completed job from the queue
+func (d *downloader) forget(job *PendingDownload) {
+	if job.ID == 0 {
+		return
+	}
+	tx := d.db.Delete(&PendingDownload{}, job.ID)
+	if tx.Error != nil {
+		log.Printf("Error removing download %d from queue\n", job.ID)
+	}
+}
+
+// Periodically feeds the workers with the persisted jobs due
+func (d *downloader) retryLoop() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		d.retryDue()
+		select {
+		case <-ticker.C:
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *downloader) retryDue() {
+	var due []*PendingDownload
+	tx := d.db.
+		Where("next_attempt <= ? AND attempts < ?", time.Now(), d.conf.maxAttempts).
+		Order("next_attempt").
+		Limit(100).
+		Find(&due)
+	if tx.Error != nil {
+		log.Println("Error reading download queue")
+		return
+	}
+	for _, job := range due {
+		// Pushed forward so the next tick doesn't pick it up again
+		// while it's still waiting for a worker
+		tx := d.db.Model(job).Update("next_attempt", time.Now().Add(time.Hour))
+		if tx.Error != nil {
+			log.Println("Error claiming queued download")
+			continue
+		}
+		d.Enqueue(job)
+		if d.ctx.Err() != nil {
+			return
+		}
+	}
+}
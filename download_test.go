@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Fails the first requests with the given status, then serves a PNG
+type flakyServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures int
+	status   int
+	body     []byte
+	hits     int
+}
+
+func newFlakyServer(t *testing.T, failures int, status int) *flakyServer {
+	f := &flakyServer{failures: failures, status: status, body: testPNG(1)}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.hits++
+		if f.hits <= f.failures {
+			w.WriteHeader(f.status)
+			return
+		}
+		w.Write(f.body)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *flakyServer) requests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.hits
+}
+
+var testDownloaderConf = downloaderConf{workers: 1, timeout: 5 * time.Second, retries: 3, backoff: time.Millisecond, maxAttempts: 3}
+
+// Downloader without workers, the tests run the jobs themselves
+func newTestDownloader(ctx context.Context, db *gorm.DB, handler downloadHandler) *downloader {
+	policy := defaultMediaPolicy
+	resolve := func(ctx context.Context, job *PendingDownload) (string, error) {
+		return job.URL, nil
+	}
+	return newDownloader(ctx, testDownloaderConf, &policy, db, handler, resolve)
+}
+
+type downloaded struct {
+	mu    sync.Mutex
+	jobs  []*PendingDownload
+	types []string
+}
+
+func (d *downloaded) handle(job *PendingDownload, content []byte, mimeType string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.jobs = append(d.jobs, job)
+	d.types = append(d.types, mimeType)
+}
+
+func TestDownloaderRetries(t *testing.T) {
+	server := newFlakyServer(t, 2, http.StatusBadGateway)
+	var done downloaded
+	d := newTestDownloader(context.Background(), nil, done.handle)
+
+	d.run(&PendingDownload{URL: server.URL, FileName: "a.png"})
+	if len(done.jobs) != 1 || done.types[0] != "image/png" {
+		t.Fatalf("got %d downloads %v, want 1 image/png", len(done.jobs), done.types)
+	}
+	if n := server.requests(); n != 3 {
+		t.Errorf("got %d requests, want 3", n)
+	}
+}
+
+// Retrying doesn't change what the file is
+func TestDownloaderRejectsWithoutRetry(t *testing.T) {
+	server := newFlakyServer(t, 0, http.StatusOK)
+	server.body = []byte("<html><body>not a meme</body></html>")
+	var done downloaded
+	d := newTestDownloader(context.Background(), nil, done.handle)
+
+	d.run(&PendingDownload{URL: server.URL, FileName: "a.png"})
+	if len(done.jobs) != 0 {
+		t.Errorf("page downloaded as media")
+	}
+	if n := server.requests(); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+}
+
+func TestDownloaderDelay(t *testing.T) {
+	d := &downloader{conf: downloaderConf{backoff: time.Second}}
+	for attempt := 0; attempt < 40; attempt++ {
+		limit := time.Second << attempt
+		if limit > time.Hour || limit <= 0 {
+			limit = time.Hour
+		}
+		for i := 0; i < 20; i++ {
+			delay := d.delay(attempt)
+			if delay < limit/2 || delay > limit {
+				t.Fatalf("attempt %d: delay %v out of [%v, %v]", attempt, delay, limit/2, limit)
+			}
+		}
+	}
+}
+
+func loadJobs(t *testing.T, d *downloader) []*PendingDownload {
+	t.Helper()
+	var jobs []*PendingDownload
+	if err := d.db.Order("id").Find(&jobs).Error; err != nil {
+		t.Fatal(err)
+	}
+	return jobs
+}
+
+func TestDownloaderPersist(t *testing.T) {
+	db := testDB(t)
+	server := newFlakyServer(t, 100, http.StatusInternalServerError)
+	var done downloaded
+	d := newTestDownloader(context.Background(), db, done.handle)
+
+	// Every quick retry fails, one persisted attempt
+	job := &PendingDownload{URL: server.URL, FileName: "a.png"}
+	d.run(job)
+	jobs := loadJobs(t, d)
+	if len(jobs) != 1 || jobs[0].Attempts != 1 || jobs[0].LastError == "" || !jobs[0].NextAttempt.After(time.Now()) {
+		t.Fatalf("failed job not queued for later: %+v", jobs)
+	}
+
+	// Due again, unless out of attempts
+	exhausted := &PendingDownload{URL: server.URL, FileName: "b.png", Attempts: testDownloaderConf.maxAttempts}
+	db.Create(exhausted)
+	db.Model(&PendingDownload{}).Where("1 = 1").Update("next_attempt", time.Now().Add(-time.Minute))
+	d.retryDue()
+	select {
+	case due := <-d.jobs:
+		if due.ID != job.ID {
+			t.Errorf("got due job %d, want %d", due.ID, job.ID)
+		}
+	default:
+		t.Fatal("due job not enqueued")
+	}
+	select {
+	case due := <-d.jobs:
+		t.Errorf("exhausted job %d enqueued", due.ID)
+	default:
+	}
+
+	// The last attempt gives up, the job stays with its error
+	job.Attempts = testDownloaderConf.maxAttempts - 1
+	d.run(job)
+	jobs = loadJobs(t, d)
+	if jobs[0].Attempts != testDownloaderConf.maxAttempts {
+		t.Errorf("got %d attempts, want %d", jobs[0].Attempts, testDownloaderConf.maxAttempts)
+	}
+
+	// Completed jobs leave the queue
+	server.mu.Lock()
+	server.failures = 0
+	server.mu.Unlock()
+	job.Attempts = 1
+	d.run(job)
+	if len(done.jobs) != 1 {
+		t.Fatalf("got %d downloads, want 1", len(done.jobs))
+	}
+	if jobs = loadJobs(t, d); len(jobs) != 1 || jobs[0].ID != exhausted.ID {
+		t.Errorf("completed job still queued: %+v", jobs)
+	}
+}
+
+// Jobs interrupted by the shutdown are queued for the next start
+// without using their attempts
+func TestDownloaderShutdown(t *testing.T) {
+	db := testDB(t)
+	server := newFlakyServer(t, 0, http.StatusOK)
+	ctx, cancel := context.WithCancel(context.Background())
+	var done downloaded
+	d := newTestDownloader(ctx, db, done.handle)
+	cancel()
+
+	d.Enqueue(&PendingDownload{URL: server.URL, FileName: "a.png", Attempts: 1})
+	// Sent as the context ended, after the workers were gone
+	d.jobs <- &PendingDownload{URL: server.URL, FileName: "b.png"}
+	d.Wait()
+	// Cut short while downloading
+	d.run(&PendingDownload{URL: server.URL, FileName: "c.png"})
+
+	jobs := loadJobs(t, d)
+	if len(jobs) != 3 {
+		t.Fatalf("got %d queued jobs, want 3", len(jobs))
+	}
+	for i, want := range []int{1, 0, 0} {
+		if jobs[i].Attempts != want || jobs[i].NextAttempt.After(time.Now()) {
+			t.Errorf("%s: %d attempts, next at %v", jobs[i].FileName, jobs[i].Attempts, jobs[i].NextAttempt)
+		}
+	}
+	if len(done.jobs) != 0 {
+		t.Errorf("downloaded after the shutdown")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+// Edits can add attachments or links to a message, what is already
+// archived from it is skipped by the ingestion
+func (bot *memeBot) messageUpdateHandler(update *discordgo.MessageUpdate) {
+	if update.Message == nil {
+		return
+	}
+	if bot.guilds.forChannel(update.ChannelID) == nil {
+		return
+	}
+	message := update.Message
+	// Link unfurls come as partial updates, with the embeds only
+	if message.Author == nil {
+		var err error
+		message, err = bot.platform.ChannelMessage(update.ChannelID, update.ID)
+		if err != nil {
+			log.Printf("Error fetching edited message ID %s: %v\n", update.ID, err)
+			return
+		}
+		// Not part of the messages read through the API
+		if message.GuildID == "" {
+			message.GuildID = update.GuildID
+		}
+	}
+	if message.Author == nil || message.Author.ID == bot.platform.UserID() {
+		return
+	}
+	log.Printf("Message ID %s edited, checking for new media\n", message.ID)
+	bot.ingestMessage(message, true)
+}
+
+func (bot *memeBot) messageDeleteHandler(deleted *discordgo.MessageDelete) {
+	if bot.guilds.forChannel(deleted.ChannelID) == nil {
+		return
+	}
+	bot.sourceDeleted([]string{deleted.ID})
+}
+
+func (bot *memeBot) messageDeleteBulkHandler(deleted *discordgo.MessageDeleteBulk) {
+	if bot.guilds.forChannel(deleted.ChannelID) == nil {
+		return
+	}
+	bot.sourceDeleted(deleted.Messages)
+}
+
+func (bot *memeBot) sourceDeleted(messageIDs []string) {
+	count, err := markSourceDeleted(bot.gorm, messageIDs, time.Now(), bot.conf.hideDeleted)
+	if err != nil {
+		log.Println("Error marking deleted source messages")
+		return
+	}
+	if count > 0 {
+		log.Printf("Marked %d files as deleted from Discord\n", count)
+	}
+}
+
+// Flags the files whose original message is gone, hiding them from
+// the archive if requested
+func markSourceDeleted(db *gorm.DB, messageIDs []string, when time.Time, hide bool) (int64, error) {
+	updates := map[string]interface{}{
+		"source_deleted":    true,
+		"source_deleted_at": when,
+	}
+	if hide {
+		updates["hidden"] = true
+	}
+	tx := db.Model(&FileInfo{}).
+		Where("message_id IN ? AND source_deleted = ?", messageIDs, false).
+		Updates(updates)
+	return tx.RowsAffected, tx.Error
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+// How often the configurations are checked for changes
+const guildReloadInterval = 30 * time.Second
+
+// Settings of a single Discord server, empty emojis fall back to the
+// defaults of the bot
+type GuildConfig struct {
+	GuildID          string         `gorm:"primaryKey" json:"guild_id"`
+	ObservedChannels pq.StringArray `gorm:"type:text[]" json:"observed_channels"`
+	UpvoteEmoji      string         `json:"upvote_emoji"`
+	DownvoteEmoji    string         `json:"downvote_emoji"`
+	ModeratorRole    string         `json:"moderator_role"`
+	ShowcaseChannel  string         `json:"showcase_channel"`
+	ShowcaseSchedule string         `json:"showcase_schedule"`
+	ShowcaseMode     string         `json:"showcase_mode"`
+	// 0 keeps the global ingestion limit
+	MaxBytes         int64     `json:"max_bytes"`
+	AutoApproveScore int       `json:"auto_approve_score"`
+	UpdatedAt        time.Time `json:"updated_at"`
+
+	schedule *cronSchedule
+}
+
+func (g *GuildConfig) validate() error {
+	if g.GuildID == "" {
+		return errors.New("guild ID not provided")
+	}
+	if g.MaxBytes < 0 || g.AutoApproveScore < 0 {
+		return errors.New("limits can't be negative")
+	}
+	if g.ShowcaseMode != "" && g.ShowcaseMode != showcaseQueue && g.ShowcaseMode != showcaseDaily {
+		return fmt.Errorf("unknown showcase mode %q", g.ShowcaseMode)
+	}
+	if g.ShowcaseChannel != "" {
+		schedule, err := parseCron(g.ShowcaseSchedule)
+		if err != nil {
+			return err
+		}
+		g.schedule = schedule
+	}
+	return nil
+}
+
+// In memory copy of the guild configurations, kept in sync with the
+// database so changes apply without restarting the bot
+type guildRegistry struct {
+	mu       sync.RWMutex
+	defaults GuildConfig
+	guilds   map[string]*GuildConfig
+	channels map[string]*GuildConfig
+	// Detects changes: rows count and latest update
+	count   int64
+	version time.Time
+	// Called in the background with the guilds new to a reload, the
+	// others already have what it sets up
+	onLoad func(guilds []*GuildConfig)
+}
+
+func newGuildRegistry(defaults GuildConfig) *guildRegistry {
+	return &guildRegistry{
+		defaults: defaults,
+		guilds:   make(map[string]*GuildConfig),
+		channels: make(map[string]*GuildConfig),
+	}
+}
+
+// Creates the configuration of the default guild on first start,
+// from the environment variables used before guilds were stored
+func (g *guildRegistry) seed(db *gorm.DB) error {
+	if g.defaults.GuildID == "" {
+		return nil
+	}
+	var count int64
+	tx := db.Model(&GuildConfig{}).Count(&count)
+	if tx.Error != nil || count > 0 {
+		return tx.Error
+	}
+	seed := g.defaults
+	log.Printf("Creating configuration of guild %s\n", seed.GuildID)
+	return db.Create(&seed).Error
+}
+
+func (g *guildRegistry) load(db *gorm.DB) error {
+	var configs []*GuildConfig
+	tx := db.Find(&configs)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	g.mu.RLock()
+	previous := g.guilds
+	g.mu.RUnlock()
+
+	guilds := make(map[string]*GuildConfig)
+	channels := make(map[string]*GuildConfig)
+	var added []*GuildConfig
+	var version time.Time
+	for _, config := range configs {
+		config.UpvoteEmoji = orDefault(config.UpvoteEmoji, g.defaults.UpvoteEmoji)
+		config.DownvoteEmoji = orDefault(config.DownvoteEmoji, g.defaults.DownvoteEmoji)
+		config.ShowcaseMode = orDefault(config.ShowcaseMode, showcaseQueue)
+		if config.UpdatedAt.After(version) {
+			version = config.UpdatedAt
+		}
+		// Edited by hand in the database, the last valid one stays.
+		// Without one the guild runs with the showcase off.
+		if err := config.validate(); err != nil {
+			log.Printf("Invalid configuration of guild %s: %v\n", config.GuildID, err)
+			if last, ok := previous[config.GuildID]; ok {
+				config = last
+			} else {
+				config.ShowcaseChannel = ""
+			}
+		}
+		if _, ok := previous[config.GuildID]; !ok {
+			added = append(added, config)
+		}
+		guilds[config.GuildID] = config
+		for _, channelID := range config.ObservedChannels {
+			channels[channelID] = config
+		}
+	}
+
+	g.mu.Lock()
+	g.guilds, g.channels = guilds, channels
+	g.count, g.version = int64(len(configs)), version
+	onLoad := g.onLoad
+	g.mu.Unlock()
+
+	log.Printf("Loaded configuration of %d guilds\n", len(configs))
+	// Reloads run in the requests of the web app too, they don't wait
+	// for Discord
+	if onLoad != nil && len(added) > 0 {
+		go onLoad(added)
+	}
+	return nil
+}
+
+// Reloads the configurations whenever a row is added, changed or
+// removed, until the context is done
+func (g *guildRegistry) watch(ctx context.Context, db *gorm.DB) {
+	ticker := time.NewTicker(guildReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		var state struct {
+			Count   int64
+			Version *time.Time
+		}
+		tx := db.Model(&GuildConfig{}).Select("COUNT(*) AS count, MAX(updated_at) AS version").Scan(&state)
+		if tx.Error != nil {
+			log.Println("Error checking guild configurations")
+			continue
+		}
+		g.mu.RLock()
+		changed := state.Count != g.count || (state.Version != nil && !state.Version.Equal(g.version))
+		g.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := g.load(db); err != nil {
+			log.Println("Error reloading guild configurations")
+		}
+	}
+}
+
+// Configuration of the guild observing the channel, nil if the
+// channel is not observed
+func (g *guildRegistry) forChannel(channelID string) *GuildConfig {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.channels[channelID]
+}
+
+func (g *guildRegistry) forGuild(guildID string) *GuildConfig {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.guilds[guildID]
+}
+
+func (g *guildRegistry) list() []*GuildConfig {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	configs := make([]*GuildConfig, 0, len(g.guilds))
+	for _, config := range g.guilds {
+		configs = append(configs, config)
+	}
+	return configs
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Guilds passed to onLoad, which runs in the background
+func waitLoaded(t *testing.T, loaded chan []*GuildConfig) []string {
+	t.Helper()
+	select {
+	case guilds := <-loaded:
+		var ids []string
+		for _, guild := range guilds {
+			ids = append(ids, guild.GuildID)
+		}
+		return ids
+	case <-time.After(5 * time.Second):
+		t.Fatal("onLoad not called")
+		return nil
+	}
+}
+
+func TestGuildReload(t *testing.T) {
+	db := testDB(t)
+	registry := newGuildRegistry(GuildConfig{UpvoteEmoji: "👍", DownvoteEmoji: "👎"})
+	loaded := make(chan []*GuildConfig, 10)
+	registry.onLoad = func(guilds []*GuildConfig) { loaded <- guilds }
+
+	guild := &GuildConfig{GuildID: "10", ObservedChannels: pq.StringArray{"100"}, ShowcaseChannel: "200", ShowcaseSchedule: "0 9 * * *"}
+	if err := db.Create(guild).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.load(db); err != nil {
+		t.Fatal(err)
+	}
+	if ids := waitLoaded(t, loaded); fmt.Sprint(ids) != "[10]" {
+		t.Errorf("got %v on the first load", ids)
+	}
+
+	// Broken by hand in the database
+	db.Model(guild).Updates(map[string]interface{}{"showcase_channel": "300", "showcase_schedule": "every day"})
+	// Invalid from the start
+	broken := &GuildConfig{GuildID: "30", ObservedChannels: pq.StringArray{"301"}, ShowcaseChannel: "300", ShowcaseSchedule: "never"}
+	if err := db.Create(broken).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.load(db); err != nil {
+		t.Fatal(err)
+	}
+	if config := registry.forGuild("10"); config.ShowcaseChannel != "200" || config.schedule == nil {
+		t.Errorf("last valid configuration not kept: showcase in %q", config.ShowcaseChannel)
+	}
+	if config := registry.forChannel("301"); config == nil || config.GuildID != "30" || config.ShowcaseChannel != "" {
+		t.Errorf("unexpected configuration of a new invalid guild: %+v", config)
+	}
+	// Only the new guild is set up
+	if ids := waitLoaded(t, loaded); fmt.Sprint(ids) != "[30]" {
+		t.Errorf("got %v on a reload", ids)
+	}
+
+	// Fixed, the new one applies
+	db.Model(guild).Update("showcase_schedule", "30 18 * * 5")
+	if err := registry.load(db); err != nil {
+		t.Fatal(err)
+	}
+	if config := registry.forGuild("10"); config.ShowcaseChannel != "300" || config.ShowcaseSchedule != "30 18 * * 5" {
+		t.Errorf("fixed configuration not applied: showcase in %q", config.ShowcaseChannel)
+	}
+	select {
+	case guilds := <-loaded:
+		t.Errorf("onLoad called with %d guilds already set up", len(guilds))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Storage name of a file, derived from its content only so that two
+// different files can never overwrite each other: the first bytes of
+// the digest are used as folders to keep them small.
+// eg: 3f/a2/3fa2...e1.png
+func blobPath(digest string, fileName string) string {
+	return path.Join(digest[0:2], digest[2:4], digest+blobExt(fileName))
+}
+
+// Extension of the original name, kept only if it's a plain one
+func blobExt(fileName string) string {
+	ext := strings.ToLower(path.Ext(fileName))
+	if len(ext) > 6 {
+		return ""
+	}
+	for _, r := range ext[min(len(ext), 1):] {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return ""
+		}
+	}
+	return ext
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Warns about rows still pointing to files saved by their name
+func (bot *memeBot) checkLayout() {
+	var legacy int64
+	tx := bot.gorm.Model(&FileInfo{}).Where("path = '' OR path IS NULL").Count(&legacy)
+	if tx.Error != nil {
+		log.Println("Error counting files to migrate")
+		return
+	}
+	if legacy > 0 {
+		log.Printf("%d files use the old storage layout, run with -migrate-layout\n", legacy)
+	}
+}
+
+// Moves every file saved under its original name to the content
+// addressed layout. Files sharing a name overwrote each other on
+// disk, so only the row matching what is left gets the blob.
+func (bot *memeBot) migrateLayout() error {
+	var files []*FileInfo
+	tx := bot.gorm.Omit("Content").Where("path = '' OR path IS NULL").Find(&files)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	byName := make(map[string][]*FileInfo)
+	for _, file := range files {
+		byName[file.FileName] = append(byName[file.FileName], file)
+	}
+
+	for name, rows := range byName {
+		content, err := bot.readFile(name)
+		if err != nil {
+			log.Printf("Can't read legacy file %s: %v\n", name, err)
+			continue
+		}
+		digest := contentDigest(content)
+
+		// Prefer the row already hashed with this content, otherwise
+		// the last one saved as it was the last to write the file
+		sort.Slice(rows, func(i, j int) bool { return rows[i].ID > rows[j].ID })
+		owner := rows[0]
+		for _, row := range rows {
+			if row.Digest == digest {
+				owner = row
+				break
+			}
+		}
+
+		blob := blobPath(digest, name)
+		err = bot.storage.Put(blob, bytes.NewReader(content))
+		if err != nil {
+			return err
+		}
+		tx := bot.gorm.Model(&FileInfo{}).
+			Where("id = ?", owner.ID).
+			Updates(map[string]interface{}{"path": blob, "digest": digest})
+		if tx.Error != nil {
+			return tx.Error
+		}
+		log.Printf("Moved %s to %s (file ID %d)\n", name, blob, owner.ID)
+
+		for _, row := range rows {
+			if row != owner {
+				log.Printf("File ID %d was overwritten on disk by file ID %d, content lost\n", row.ID, owner.ID)
+			}
+		}
+
+		if blob != name {
+			err = bot.storage.Delete(name)
+			if err != nil {
+				log.Printf("Can't remove legacy file %s: %v\n", name, err)
+			}
+		}
+	}
+	return nil
+}
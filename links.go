@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var urlPattern = regexp.MustCompile(`https?://[^\s<>|]+`)
+
+// Extensions of links pointing straight to a media file
+var mediaExtensions = []string{".png", ".jpg", ".jpeg", ".gif", ".webp", ".mp4", ".webm", ".mov"}
+
+// Download jobs for the media posted as links: embeds generated by
+// Discord first, then bare URLs to media files not embedded.
+// Size and type are checked once downloaded, as links declare neither.
+func getMessageLinks(message *discordgo.Message) []*PendingDownload {
+	var links []*PendingDownload
+	seen := make(map[string]bool)
+
+	add := func(mediaURL string, sourceURL string) {
+		if mediaURL == "" || seen[mediaURL] {
+			return
+		}
+		seen[mediaURL] = true
+		seen[sourceURL] = true
+		links = append(links, &PendingDownload{
+			URL:       mediaURL,
+			SourceURL: sourceURL,
+			FileName:  linkFileName(mediaURL, len(links)),
+			Sender:    message.Author.ID,
+			GuildID:   message.GuildID,
+			ChannelID: message.ChannelID,
+			MessageID: message.ID,
+			Sent:      message.Timestamp,
+		})
+	}
+
+	for _, embed := range message.Embeds {
+		source := embed.URL
+		switch embed.Type {
+		case discordgo.EmbedTypeGifv, discordgo.EmbedTypeVideo:
+			if embed.Video != nil {
+				add(embed.Video.URL, orDefault(source, embed.Video.URL))
+			}
+		case discordgo.EmbedTypeImage:
+			// Discord puts the picture of image links in the thumbnail
+			if embed.Thumbnail != nil {
+				add(embed.Thumbnail.URL, orDefault(source, embed.Thumbnail.URL))
+			} else if embed.Image != nil {
+				add(embed.Image.URL, orDefault(source, embed.Image.URL))
+			}
+		default:
+			if embed.Image != nil {
+				add(embed.Image.URL, orDefault(source, embed.Image.URL))
+			}
+		}
+	}
+
+	for _, link := range urlPattern.FindAllString(message.Content, -1) {
+		if seen[link] || !isMediaLink(link) {
+			continue
+		}
+		add(link, link)
+	}
+	return links
+}
+
+func isMediaLink(link string) bool {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	ext := strings.ToLower(path.Ext(parsed.Path))
+	for _, mediaExt := range mediaExtensions {
+		if ext == mediaExt {
+			return true
+		}
+	}
+	return false
+}
+
+// Last segment of the URL path, links are not named like attachments
+func linkFileName(link string, index int) string {
+	if parsed, err := url.Parse(link); err == nil {
+		if name := path.Base(parsed.Path); name != "." && name != "/" {
+			return name
+		}
+	}
+	return fmt.Sprintf("link-%d", index)
+}
+
+func orDefault(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
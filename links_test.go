@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestGetMessageLinks(t *testing.T) {
+	tenor := &discordgo.MessageEmbed{
+		Type:      discordgo.EmbedTypeGifv,
+		URL:       "https://tenor.com/view/cat-123",
+		Video:     &discordgo.MessageEmbedVideo{URL: "https://media.tenor.com/abc/cat.mp4"},
+		Thumbnail: &discordgo.MessageEmbedThumbnail{URL: "https://media.tenor.com/abc/cat.png"},
+	}
+	imgur := &discordgo.MessageEmbed{
+		Type:      discordgo.EmbedTypeImage,
+		URL:       "https://i.imgur.com/a.png",
+		Thumbnail: &discordgo.MessageEmbedThumbnail{URL: "https://images-ext-1.discordapp.net/external/x/https/i.imgur.com/a.png"},
+	}
+
+	// Pairs of media and source URLs
+	type link struct{ url, source string }
+	tests := []struct {
+		name    string
+		content string
+		embeds  []*discordgo.MessageEmbed
+		want    []link
+	}{
+		{name: "gifv", content: "https://tenor.com/view/cat-123", embeds: []*discordgo.MessageEmbed{tenor}, want: []link{{"https://media.tenor.com/abc/cat.mp4", "https://tenor.com/view/cat-123"}}},
+		{name: "video without page", embeds: []*discordgo.MessageEmbed{{Type: discordgo.EmbedTypeVideo, Video: &discordgo.MessageEmbedVideo{URL: "https://cdn.example.com/v.webm"}}}, want: []link{{"https://cdn.example.com/v.webm", "https://cdn.example.com/v.webm"}}},
+		{name: "video not playable", embeds: []*discordgo.MessageEmbed{{Type: discordgo.EmbedTypeVideo, URL: "https://youtube.com/watch?v=1"}}},
+		{name: "image from the thumbnail", content: "look https://i.imgur.com/a.png", embeds: []*discordgo.MessageEmbed{imgur}, want: []link{{imgur.Thumbnail.URL, "https://i.imgur.com/a.png"}}},
+		{name: "image without thumbnail", embeds: []*discordgo.MessageEmbed{{Type: discordgo.EmbedTypeImage, Image: &discordgo.MessageEmbedImage{URL: "https://cdn.example.com/b.jpg"}}}, want: []link{{"https://cdn.example.com/b.jpg", "https://cdn.example.com/b.jpg"}}},
+		{name: "article image", embeds: []*discordgo.MessageEmbed{{Type: discordgo.EmbedTypeArticle, URL: "https://news.example.com/1", Image: &discordgo.MessageEmbedImage{URL: "https://news.example.com/1.jpg"}}}, want: []link{{"https://news.example.com/1.jpg", "https://news.example.com/1"}}},
+		{name: "article without image", content: "https://news.example.com/1", embeds: []*discordgo.MessageEmbed{{Type: discordgo.EmbedTypeArticle, URL: "https://news.example.com/1"}}},
+		{name: "bare links", content: "https://example.com/a.GIF and https://example.com/b.mp4?size=large", want: []link{{"https://example.com/a.GIF", "https://example.com/a.GIF"}, {"https://example.com/b.mp4?size=large", "https://example.com/b.mp4?size=large"}}},
+		{name: "duplicate links", content: "https://example.com/a.png https://example.com/a.png", want: []link{{"https://example.com/a.png", "https://example.com/a.png"}}},
+		{name: "duplicate embeds", embeds: []*discordgo.MessageEmbed{tenor, tenor}, want: []link{{"https://media.tenor.com/abc/cat.mp4", "https://tenor.com/view/cat-123"}}},
+		{name: "embedded link also in the text", content: "https://media.tenor.com/abc/cat.mp4", embeds: []*discordgo.MessageEmbed{tenor}, want: []link{{"https://media.tenor.com/abc/cat.mp4", "https://tenor.com/view/cat-123"}}},
+		{name: "non media links", content: "https://example.com/page <https://example.com/notes.txt> https://example.com/"},
+		{name: "no links", content: "just a .png"},
+	}
+	sent := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := &discordgo.Message{
+				ID: "900", GuildID: testGuild, ChannelID: testChannel, Timestamp: sent,
+				Author: &discordgo.User{ID: testSender}, Content: test.content, Embeds: test.embeds,
+			}
+			var got []link
+			for _, job := range getMessageLinks(message) {
+				got = append(got, link{job.URL, job.SourceURL})
+				if job.Sender != testSender || job.GuildID != testGuild || job.ChannelID != testChannel || job.MessageID != "900" || !job.Sent.Equal(sent) {
+					t.Errorf("message not copied in job %+v", job)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLinkFileName(t *testing.T) {
+	tests := []struct {
+		link string
+		want string
+	}{
+		{link: "https://media.tenor.com/abc/cat.mp4", want: "cat.mp4"},
+		{link: "https://example.com/b.mp4?size=large", want: "b.mp4"},
+		{link: "https://example.com/", want: "link-2"},
+		{link: "https://example.com", want: "link-2"},
+	}
+	for _, test := range tests {
+		if got := linkFileName(test.link, 2); got != test.want {
+			t.Errorf("linkFileName(%q) = %q, want %q", test.link, got, test.want)
+		}
+	}
+}
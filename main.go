@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"memegrab/cattp"
 	"memegrab/sessions"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -26,8 +33,13 @@ type DatabaseRequired interface {
 // 	get()
 // }
 
+// Settings can also come from the environment only, eg: in the tests
 func init() {
 	err := godotenv.Load(".env")
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Println("No '.env' file, using the environment")
+		return
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -35,61 +47,169 @@ func init() {
 }
 
 func main() {
+	migrateLayout := flag.Bool("migrate-layout", false, "move files saved by name to the content addressed layout and exit")
+	flag.Parse()
+
 	var wg sync.WaitGroup
 
 	conf := &memeBotConf{
-		token:   os.Getenv("BOT_TOKEN"),
-		guildId: os.Getenv("BOT_GUILD_ID"),
-		observedChannels: func() []string {
-			chans := strings.Trim(strings.TrimSpace(os.Getenv("BOT_CHANNELS")), ":")
-			if chans == "" {
-				return []string{}
+		token: os.Getenv("BOT_TOKEN"),
+		// Used for the guild configuration created on first start
+		defaults: GuildConfig{
+			GuildID: os.Getenv("BOT_GUILD_ID"),
+			ObservedChannels: func() []string {
+				chans := strings.Trim(strings.TrimSpace(os.Getenv("BOT_CHANNELS")), ":")
+				if chans == "" {
+					return []string{}
+				}
+				return strings.FieldsFunc(chans, func(r rune) bool {
+					return r == ':' || r == ' '
+				})
+			}(),
+			ModeratorRole: os.Getenv("BOT_MOD_ROLE"),
+			UpvoteEmoji:   orDefault(os.Getenv("BOT_UPVOTE"), "👍"),
+			DownvoteEmoji: orDefault(os.Getenv("BOT_DOWNVOTE"), "👎"),
+			AutoApproveScore: func() int {
+				score, _ := strconv.Atoi(os.Getenv("BOT_AUTO_APPROVE_SCORE"))
+				return score
+			}(),
+			ShowcaseChannel:  os.Getenv("SHOWCASE_CHANNEL"),
+			ShowcaseSchedule: orDefault(os.Getenv("SHOWCASE_SCHEDULE"), "0 12 * * *"),
+			ShowcaseMode:     orDefault(os.Getenv("SHOWCASE_MODE"), showcaseQueue),
+		},
+		repostCallout: os.Getenv("BOT_REPOST_CALLOUT") == "true",
+		hideDeleted:   os.Getenv("BOT_HIDE_DELETED") == "true",
+		similarity: func() float64 {
+			similarity, err := strconv.ParseFloat(os.Getenv("BOT_REPOST_SIMILARITY"), 64)
+			if err != nil || similarity <= 0 || similarity > 1 {
+				return 0.9
 			}
-			return strings.FieldsFunc(chans, func(r rune) bool {
-				return r == ':' || r == ' '
-			})
+			return similarity
 		}(),
+		media: func() mediaPolicy {
+			policy := defaultMediaPolicy
+			if maxBytes, err := strconv.ParseInt(os.Getenv("INGEST_MAX_BYTES"), 10, 64); err == nil {
+				policy.maxBytes = maxBytes
+			}
+			if types := strings.TrimSpace(os.Getenv("INGEST_ALLOWED_TYPES")); types != "" {
+				policy.allowedTypes = strings.FieldsFunc(types, func(r rune) bool {
+					return r == ',' || r == ' '
+				})
+			}
+			return policy
+		}(),
+		review: reviewPolicy{
+			name: orDefault(os.Getenv("REVIEW_POLICY"), policySingle),
+			quorum: func() int {
+				quorum, err := strconv.Atoi(os.Getenv("REVIEW_QUORUM"))
+				if err != nil {
+					return 2
+				}
+				return quorum
+			}(),
+			panel: func() int {
+				panel, err := strconv.Atoi(os.Getenv("REVIEW_PANEL"))
+				if err != nil {
+					return 3
+				}
+				return panel
+			}(),
+			adminVeto: os.Getenv("REVIEW_ADMIN_VETO") == "true",
+			undoWindow: func() time.Duration {
+				window, err := time.ParseDuration(os.Getenv("REVIEW_UNDO_WINDOW"))
+				if err != nil || window < 0 {
+					return defaultUndoWindow
+				}
+				return window
+			}(),
+		},
+	}
+	if err := conf.review.validate(); err != nil {
+		panic(err)
 	}
 
+	// Stopped on interrupt, pending downloads are persisted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Starting a new bot instance
-	bot := New(conf)
+	bot := New(ctx, conf)
 	defer bot.db.Close()
+	defer bot.platform.Close()
 
-	err := migrateTables(bot.gorm)
+	err := migrateTables(bot.gorm, conf.defaults.GuildID)
 	if err != nil {
 		panic(err)
 	}
 
-	dbFiles := getDbMessages(bot.gorm)
-
-	for _, file := range dbFiles {
-		fmt.Printf("DB Info: %d - Filename: %s\n", file.ID, file.FileName)
-	}
-
-	messages := getChannelMessages(bot.discord, conf)
-
-	for _, message := range messages {
-		if len(message.Attachments) == 0 {
-			continue
+	// One-shot rewrite of the files saved with the old layout
+	if *migrateLayout {
+		err = bot.migrateLayout()
+		if err != nil {
+			panic(err)
 		}
+		log.Println("Storage layout migration completed")
+		return
+	}
+	bot.checkLayout()
+	// Before anything is ingested, messages may already be coming in
+	bot.downloads.Start()
 
-		files := getMessageAttachment(message)
-
-		for i, file := range files {
+	// Guild configurations, seeded from the environment on first start
+	err = bot.guilds.seed(bot.gorm)
+	if err != nil {
+		panic(err)
+	}
+	err = bot.guilds.load(bot.gorm)
+	if err != nil {
+		panic(err)
+	}
 
-			if checkFileExists(bot.gorm, file) {
-				continue
-			}
+	dbFiles := getDbMessages(bot.gorm, "id", nil)
 
-			log.Printf("Saving file: %v", i)
+	for _, file := range dbFiles {
+		fmt.Printf("DB Info: %d - Filename: %s\n", file.ID, file.FileName)
+	}
 
-			if err := bot.saveAttachment(file); err != nil {
-				log.Println("Error in saving attachment file")
-				return
-			}
-		}
+	// Items claimed from the review queue and never decided
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runClaimSweeper(ctx, bot.gorm)
+	}()
+
+	// Apply configuration changes made directly on the database
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		bot.guilds.watch(ctx, bot.gorm)
+	}()
+
+	// Archive the full history of the observed channels in background
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		bot.backfill(ctx)
+	}()
+
+	// Collect from the other chats too, with the same pipeline
+	for _, source := range bot.sources {
+		wg.Add(1)
+		go func(source ingestSource) {
+			defer wg.Done()
+			source.Run(ctx, func(jobs []*PendingDownload) {
+				bot.ingest(jobs, true)
+			})
+		}(source)
 	}
 
+	// Repost approved memes to the showcase channel, if configured
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		bot.runShowcase(ctx)
+	}()
+
 	// Get a session manager instance
 	sessionLen := time.Hour * 720
 	sessions := sessions.New(sessionLen)
@@ -104,10 +224,15 @@ func main() {
 		URL: os.Getenv("HTTP_URL"),
 	}
 
-	err = startWebApp(httpConf, bot.db, bot.gorm, sessions)
+	go func() {
+		err := startWebApp(httpConf, bot.db, bot.gorm, bot.storage, sessions, bot.guilds, bot.conf.review, bot.fileReviewed)
+		if err != nil {
+			panic(err)
+		}
+	}()
 
-	if err != nil {
-		panic(err)
-	}
+	<-ctx.Done()
+	log.Println("Shutting down")
 	wg.Wait()
+	bot.downloads.Wait()
 }
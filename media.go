@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+var (
+	errTooLarge       = errors.New("file exceeds the size limit")
+	errTypeNotAllowed = errors.New("media type not allowed")
+)
+
+// What the bot accepts to archive
+type mediaPolicy struct {
+	maxBytes int64
+	// Exact media types ("video/mp4") or families ending with a
+	// slash ("image/")
+	allowedTypes []string
+}
+
+var defaultMediaPolicy = mediaPolicy{
+	maxBytes:     25 << 20,
+	allowedTypes: []string{"image/", "video/mp4", "video/webm", "video/quicktime"},
+}
+
+func (p *mediaPolicy) allows(mimeType string) bool {
+	for _, allowed := range p.allowedTypes {
+		if strings.HasSuffix(allowed, "/") && strings.HasPrefix(mimeType, allowed) {
+			return true
+		}
+		if mimeType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks what the platform declares before downloading anything
+func (p *mediaPolicy) precheck(size int64, declaredType string) error {
+	if p.maxBytes > 0 && size > p.maxBytes {
+		return fmt.Errorf("%w: %d bytes", errTooLarge, size)
+	}
+	if declaredType != "" && !p.allows(baseType(declaredType)) {
+		return fmt.Errorf("%w: declared %s", errTypeNotAllowed, declaredType)
+	}
+	return nil
+}
+
+// Streams the file stopping as soon as the size limit is crossed,
+// then sniffs its media type from the content itself.
+// Returns the content and the detected media type.
+func fetchMedia(ctx context.Context, url string, declaredType string, policy *mediaPolicy) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status %s", res.Status)
+	}
+	if policy.maxBytes > 0 && res.ContentLength > policy.maxBytes {
+		return nil, "", fmt.Errorf("%w: %d bytes", errTooLarge, res.ContentLength)
+	}
+
+	body := io.Reader(res.Body)
+	if policy.maxBytes > 0 {
+		body = io.LimitReader(res.Body, policy.maxBytes+1)
+	}
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, "", err
+	}
+	if policy.maxBytes > 0 && int64(len(content)) > policy.maxBytes {
+		return nil, "", fmt.Errorf("%w: more than %d bytes", errTooLarge, policy.maxBytes)
+	}
+
+	mimeType := sniffType(content, declaredType)
+	if !policy.allows(mimeType) {
+		return nil, "", fmt.Errorf("%w: %s", errTypeNotAllowed, mimeType)
+	}
+	return content, mimeType, nil
+}
+
+// Media types the sniffer can't recognize from the content
+var unsniffableTypes = []string{"video/quicktime", "image/heic", "image/heif", "image/avif"}
+
+// The sniffer doesn't know every container (eg: QuickTime), only for
+// those the type declared by the sender is trusted. Anything else it
+// can't recognize stays a binary, whatever the sender says.
+func sniffType(content []byte, declaredType string) string {
+	mimeType := baseType(http.DetectContentType(content))
+	if mimeType != "application/octet-stream" {
+		return mimeType
+	}
+	declared := baseType(declaredType)
+	for _, unsniffable := range unsniffableTypes {
+		if declared == unsniffable {
+			return declared
+		}
+	}
+	return mimeType
+}
+
+// Drops parameters, eg: "text/plain; charset=utf-8" is "text/plain"
+func baseType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return mediaType
+}
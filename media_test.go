@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Start of a QuickTime movie, unknown to the sniffer
+var testQuickTime = []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x02\x00qt  \x00\x00\x00\x08wide")
+
+func TestSniffType(t *testing.T) {
+	binary := []byte{0x00, 0x01, 0x02, 0x03, 0xfe, 0xff}
+	tests := []struct {
+		name     string
+		content  []byte
+		declared string
+		want     string
+	}{
+		{name: "png", content: testPNG(1), want: "image/png"},
+		{name: "content over the declared type", content: testPNG(1), declared: "video/mp4", want: "image/png"},
+		{name: "quicktime", content: testQuickTime, declared: "video/quicktime", want: "video/quicktime"},
+		{name: "declared with parameters", content: testQuickTime, declared: "video/quicktime; codecs=avc1", want: "video/quicktime"},
+		{name: "binary declared as an image", content: binary, declared: "image/png", want: "application/octet-stream"},
+		{name: "binary declared as mp4", content: binary, declared: "video/mp4", want: "application/octet-stream"},
+		{name: "binary", content: binary, want: "application/octet-stream"},
+		{name: "html", content: []byte("<html><body>hi</body></html>"), declared: "image/png", want: "text/html"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := sniffType(test.content, test.declared); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPrecheck(t *testing.T) {
+	policy := mediaPolicy{maxBytes: 1000, allowedTypes: []string{"image/", "video/mp4"}}
+	tests := []struct {
+		name     string
+		size     int64
+		declared string
+		want     error
+	}{
+		{name: "allowed", size: 1000, declared: "image/png"},
+		{name: "exact type", size: 10, declared: "video/mp4"},
+		{name: "with parameters", size: 10, declared: "image/jpeg; q=1"},
+		{name: "unknown type and size", size: 0, declared: ""},
+		{name: "too large", size: 1001, declared: "image/png", want: errTooLarge},
+		{name: "type not allowed", size: 10, declared: "video/webm", want: errTypeNotAllowed},
+		{name: "family prefix only", size: 10, declared: "imagery/png", want: errTypeNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := policy.precheck(test.size, test.declared)
+			if !errors.Is(err, test.want) || (test.want == nil && err != nil) {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+
+	unlimited := mediaPolicy{allowedTypes: []string{"image/"}}
+	if err := unlimited.precheck(1<<40, "image/gif"); err != nil {
+		t.Errorf("got %v without a size limit", err)
+	}
+}
+
+func TestFetchMedia(t *testing.T) {
+	content := testPNG(1)
+	var withLength bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if withLength {
+			w.Header().Set("Content-Length", "1000000")
+		}
+		// Flushed in pieces, chunked when the length isn't given
+		for i := 0; i < 4; i++ {
+			w.Write(content)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+	total := int64(4 * len(content))
+
+	tests := []struct {
+		name       string
+		maxBytes   int64
+		withLength bool
+		want       error
+	}{
+		{name: "under the limit", maxBytes: total},
+		{name: "no limit", maxBytes: 0},
+		{name: "over the limit while streaming", maxBytes: total - 1, want: errTooLarge},
+		{name: "declared over the limit", maxBytes: total, withLength: true, want: errTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withLength = test.withLength
+			policy := mediaPolicy{maxBytes: test.maxBytes, allowedTypes: defaultMediaPolicy.allowedTypes}
+			got, mimeType, err := fetchMedia(context.Background(), server.URL, "", &policy)
+			if !errors.Is(err, test.want) || (test.want == nil && err != nil) {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+			if test.want == nil && (int64(len(got)) != total || mimeType != "image/png") {
+				t.Errorf("got %d bytes of %s", len(got), mimeType)
+			}
+			if test.want != nil && got != nil {
+				t.Errorf("got %d bytes along with the error", len(got))
+			}
+		})
+	}
+
+	// Sniffed, whatever the sender declares
+	withLength = false
+	policy := mediaPolicy{maxBytes: total, allowedTypes: []string{"video/"}}
+	if _, _, err := fetchMedia(context.Background(), server.URL, "video/mp4", &policy); !errors.Is(err, errTypeNotAllowed) {
+		t.Errorf("got %v fetching a PNG declared as mp4, want errTypeNotAllowed", err)
+	}
+}
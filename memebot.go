@@ -1,32 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
-	"net/http"
+	"memegrab/storage"
 	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
-	"golang.org/x/exp/slices"
+	"github.com/lib/pq"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
-func New(botConfig *memeBotConf) *memeBot {
-	// Create new Discord session
-	botSession, err := discordgo.New(fmt.Sprintf("Bot %s", os.Getenv("BOT_TOKEN")))
+// Handlers may fire as soon as the platform is open, the downloader
+// needs the context from the start
+func New(ctx context.Context, botConfig *memeBotConf) *memeBot {
+	platform, err := newDiscordPlatform(botConfig.token)
 	if err != nil {
 		panic(err)
 	}
 
-	// Create websocket with discord
-	err = botSession.Open()
+	// Connect to the chat, a websocket for Discord
+	err = platform.Open()
 	if err != nil {
 		panic(err)
 	}
@@ -56,102 +57,294 @@ func New(botConfig *memeBotConf) *memeBot {
 		panic(err)
 	}
 
+	// Start the backend where attachments are kept
+	store, err := storage.New(storage.Config{
+		Backend: os.Getenv("STORAGE_BACKEND"),
+		Root:    os.Getenv("STORAGE_ROOT"),
+		S3: storage.S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			PathStyle: os.Getenv("S3_PATH_STYLE") == "true",
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
 	// Instance reference to bot context
 	memeBot := &memeBot{
-		discord: botSession,
-		conf:    botConfig,
-		db:      db,
-		gorm:    dbGorm,
+		platform: platform,
+		conf:     botConfig,
+		db:       db,
+		gorm:     dbGorm,
+		storage:  store,
+		guilds:   newGuildRegistry(botConfig.defaults),
 	}
+	memeBot.guilds.onLoad = memeBot.registerCommands
+	memeBot.sources = newIngestSources(&botConfig.media)
+	memeBot.downloads = newDownloader(ctx, defaultDownloaderConf, &botConfig.media, dbGorm, memeBot.storeMedia, memeBot.resolveURL)
 
-	// Add Handler for messages
-	botSession.AddHandler(memeBot.messageHandler)
+	memeBot.addHandlers()
 
 	return memeBot
 }
 
+// Hooks the bot to the events of the chat platform
+func (bot *memeBot) addHandlers() {
+	// Add Handler for messages
+	bot.platform.AddHandler(bot.messageHandler)
+	bot.platform.AddHandler(bot.messageUpdateHandler)
+	bot.platform.AddHandler(bot.messageDeleteHandler)
+	bot.platform.AddHandler(bot.messageDeleteBulkHandler)
+
+	// Add Handler for reactions
+	bot.platform.AddHandler(bot.reactionAddHandler)
+	bot.platform.AddHandler(bot.reactionRemoveHandler)
+
+	// Add Handler for slash commands, registered once guilds are loaded
+	bot.platform.AddHandler(bot.interactionHandler)
+}
+
 type memeBot struct {
-	discord *discordgo.Session
-	conf    *memeBotConf
-	db      *sql.DB
-	gorm    *gorm.DB
+	platform  chatPlatform
+	conf      *memeBotConf
+	db        *sql.DB
+	gorm      *gorm.DB
+	storage   storage.Storage
+	downloads *downloader
+	guilds    *guildRegistry
+	// Chats archived besides Discord
+	sources []ingestSource
 }
 
-func (bot *memeBot) messageHandler(session *discordgo.Session, message *discordgo.MessageCreate) {
-	log.Printf("New message from %v (%v)\n", message.Member.Nick, message.Author.ID)
+func (bot *memeBot) messageHandler(message *discordgo.MessageCreate) {
+	if message.Author == nil {
+		return
+	}
+	log.Printf("New message from %v (%v)\n", message.Author.Username, message.Author.ID)
 
-	if message.Author.ID == session.State.User.ID {
+	if message.Author.ID == bot.platform.UserID() {
 		return
 	}
-	if len(message.Attachments) == 0 {
+	isObservedChannel := bot.guilds.forChannel(message.ChannelID) != nil
+
+	if !isObservedChannel {
 		return
 	}
 
-	isObservedChannel := slices.Contains(bot.conf.observedChannels, message.ChannelID)
+	bot.ingestMessage(message.Message, true)
+}
+
+// A file of a message that matches one already in the archive
+type repostMatch struct {
+	file       *FileInfo
+	original   *FileInfo
+	similarity float64
+}
 
-	if !isObservedChannel {
+// Queues every attachment and linked media of the message not already
+// archived, shared by the live handler and the backfill.
+// Returns whether the message carries any media.
+func (bot *memeBot) ingestMessage(message *discordgo.Message, live bool) bool {
+	guild := bot.guilds.forChannel(message.ChannelID)
+	if message.Author == nil || guild == nil {
+		return false
+	}
+	policy := bot.conf.media
+	if guild.MaxBytes > 0 {
+		policy.maxBytes = guild.MaxBytes
+	}
+
+	channelName := ""
+	if channel, err := bot.platform.Channel(message.ChannelID); err == nil {
+		channelName = channel.Name
+	}
+
+	jobs := append(getMessageAttachment(message, &policy), getMessageLinks(message)...)
+	for _, job := range jobs {
+		job.Platform = platformDiscord
+		job.SuggestedTags = suggestTags(message.Content, channelName, job.FileName)
+		job.MessageText = message.Content
+		job.SenderName = senderName(message)
+		job.GuildID = guild.GuildID
+		job.MaxBytes = policy.maxBytes
+	}
+	bot.ingest(jobs, live)
+	return len(jobs) > 0
+}
+
+// Saves a downloaded media unless the same content is already stored,
+// in which case it's recorded as a repost
+func (bot *memeBot) storeMedia(job *PendingDownload, content []byte, mimeType string) {
+	sent := job.Sent
+	file := &FileInfo{
+		Platform:  job.Platform,
+		FileName:  job.FileName,
+		SourceURL: job.SourceURL,
+		Digest:    contentDigest(content),
+		MimeType:  mimeType,
+		Size:      int64(len(content)),
+		Sender:    job.Sender,
+		GuildID:   job.GuildID,
+		ChannelID: job.ChannelID,
+		MessageID: job.MessageID,
+		Sent:      &sent,
+		Content:   &content,
+
+		SuggestedTags: job.SuggestedTags,
+		MessageText:   job.MessageText,
+		SenderName:    job.SenderName,
+	}
+
+	match, err := bot.storeFile(file)
+	if err != nil {
+		log.Println("Error in saving attachment file")
 		return
 	}
+	// Reactions and replies are only posted on Discord
+	if job.Platform != platformDiscord {
+		return
+	}
+	// Historic messages are left alone, only new posts get the state
+	if job.Live && file.ID != 0 {
+		bot.syncReactions(file.ChannelID, file.MessageID)
+	}
+	// Links without a source message can't be pointed to
+	if match != nil && job.Live && bot.conf.repostCallout && match.original.MessageID != "" && match.original.Platform == platformDiscord {
+		bot.calloutRepost(file, match)
+	}
+}
 
-	if rand.Intn(2) == 0 {
-		err := session.MessageReactionAdd(message.ChannelID, message.ID, "💾")
+// Saves the file, or records it as a repost of the one with the same
+// content. The workers store concurrently, so the lookup and the
+// insert are done holding a lock on the digest.
+func (bot *memeBot) storeFile(file *FileInfo) (*repostMatch, error) {
+	var match *repostMatch
+	err := bot.gorm.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", file.Digest).Error
 		if err != nil {
-			log.Println("Error in adding reaction to message")
-			return
+			return err
 		}
-		log.Printf("Reacted with 💾 to message ID: %s\n", message.ID)
-	} else {
-		err := session.MessageReactionAdd(message.ChannelID, message.ID, "🍌")
-		if err != nil {
-			log.Println("Error in adding reaction to message")
-			return
-		}
-		log.Printf("Reacted with 🍌 to message ID: %s\n", message.ID)
+		match, err = bot.storeFileLocked(tx, file)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	// Votes may have been cast before the download completed
+	if file.ID != 0 && file.Platform == platformDiscord {
+		bot.refreshScore(file.ChannelID, file.MessageID)
+	}
+	return match, nil
+}
 
-	files := getMessageAttachment(message.Message)
-	for i, file := range files {
-		if checkFileExists(bot.gorm, file) {
-			return
+func (bot *memeBot) storeFileLocked(tx *gorm.DB, file *FileInfo) (*repostMatch, error) {
+	original, err := findByDigest(tx, file.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if original != nil {
+		// Already archived from this very message, nothing new
+		if original.ChannelID == file.ChannelID && original.MessageID == file.MessageID {
+			return nil, nil
+		}
+		if err := recordRepost(tx, original, file); err != nil {
+			return nil, err
 		}
-		log.Println("Not found on DB, saving")
-		err := bot.saveAttachment(file)
+		return &repostMatch{file: file, original: original, similarity: 1}, nil
+	}
+
+	// Not the same bytes, but it might still be the same picture
+	var match *repostMatch
+	if hash, err := perceptualHash(*file.Content); err == nil {
+		signed := int64(hash)
+		file.PHash = &signed
+		similar, similarity, err := findSimilar(tx, hash, bot.conf.similarity)
 		if err != nil {
-			log.Println("Error in saving attachment file")
-			return
+			log.Println("Error looking up similar files")
+		}
+		if similar != nil {
+			file.NearDuplicateOf = &similar.ID
+			match = &repostMatch{file: file, original: similar, similarity: similarity}
 		}
-		log.Printf("Saving file: %v", i)
 	}
+
+	log.Println("Not found on DB, saving")
+	err = bot.saveAttachment(tx, file)
+	if err != nil {
+		return nil, err
+	}
+	return match, nil
+}
+
+// Replies to the message pointing to where the meme was first posted
+func (bot *memeBot) calloutRepost(file *FileInfo, match *repostMatch) {
+	guildID := match.original.GuildID
+	if guildID == "" {
+		guildID = bot.conf.defaults.GuildID
+	}
+	link := fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guildID, match.original.ChannelID, match.original.MessageID)
+	content := fmt.Sprintf("Repost detected (%.0f%% similar), originally posted here: %s", match.similarity*100, link)
+
+	reference := &discordgo.MessageReference{
+		MessageID: file.MessageID,
+		ChannelID: file.ChannelID,
+		GuildID:   file.GuildID,
+	}
+	_, err := bot.platform.SendMessage(file.ChannelID, &discordgo.MessageSend{Content: content, Reference: reference})
+	if err != nil {
+		log.Println("Error in replying to repost")
+		return
+	}
+	log.Printf("Called out repost of file ID %d in message ID: %s\n", match.original.ID, file.MessageID)
 }
 
-func (bot *memeBot) saveAttachment(file *FileInfo) error {
+func (bot *memeBot) saveAttachment(db *gorm.DB, file *FileInfo) error {
 	if file == nil {
 		return errors.New("file is nil")
 	}
 
-	localFile, err := os.Create(filepath.Join("img", file.FileName))
+	file.Path = blobPath(file.Digest, file.FileName)
+	err := bot.storage.Put(file.Path, bytes.NewReader(*file.Content))
 	if err != nil {
-		log.Println("Error creating new file")
+		log.Println("Error writing to storage")
 		return err
 	}
-	written, err := localFile.Write(*file.Content)
-	if err != nil {
-		log.Println("Error writing to file")
-		return err
+	log.Printf("Written %d bytes to file %s\n", len(*file.Content), file.Path)
+
+	// Not every attachment is a picture, those go without preview
+	thumb, err := makeThumbnail(*file.Content)
+	if err == nil {
+		file.Width, file.Height = thumb.width, thumb.height
+		file.ThumbPath = thumbPath(file.Digest, thumb.ext)
+		err = bot.storage.Put(file.ThumbPath, bytes.NewReader(thumb.content))
+		if err != nil {
+			log.Println("Error writing thumbnail to storage")
+			file.ThumbPath = ""
+		}
 	}
-	log.Printf("Written %d bytes to file %s\n", written, localFile.Name())
 
 	// Gorm updates our custom type instance with the ID returned
-	tx := bot.gorm.
+	tx := db.
 		Clauses(clause.Returning{}).
 		Omit("Content").
 		Create(&file)
 
 	if tx.Error != nil {
-		panic(err)
+		return tx.Error
 	}
 	// GORM TEST
 	log.Printf("Saved file %s in DB with ID %d WITH GORM\n", file.FileName, file.ID)
+	// In a savepoint, a failure here shouldn't lose the file
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return refreshSearchVector(tx, []int{file.ID})
+	})
+	if err != nil {
+		log.Printf("Error indexing file ID %d for search\n", file.ID)
+	}
 	// var gormFileRead FileInfo
 	// _testGorm.Table("file_info").First(&gormFileRead, "file_name = ?", attach.Filename)
 	// fmt.Println(gormFile)
@@ -159,97 +352,143 @@ func (bot *memeBot) saveAttachment(file *FileInfo) error {
 
 }
 
+// Reads back a whole stored file
+func (bot *memeBot) readFile(name string) ([]byte, error) {
+	content, err := bot.storage.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	return io.ReadAll(content)
+}
+
+// Settings shared by every guild, the per guild ones are in GuildConfig
 type memeBotConf struct {
-	token            string
-	guildId          string
-	observedChannels []string
+	token string
+	// Configuration of the guild created on first start, its emojis are
+	// used by the guilds that don't set their own
+	defaults GuildConfig
+	// Reply to reposts with a link to the original message
+	repostCallout bool
+	// Minimum perceptual similarity (0-1) to consider two images the same
+	similarity float64
+	media      mediaPolicy
+	// Hide from the archive the files whose message was deleted
+	hideDeleted bool
+	review      reviewPolicy
 }
 
 type FileInfo struct {
-	ID           int        `gorm:"primaryKey" json:"id,omitempty"`
-	FileName     string     `gorm:"file_name" json:"file_name,omitempty"`
-	Sender       string     `gorm:"sender" json:"sender,omitempty"`
-	Sent         *time.Time `gorm:"sent" json:"sent,omitempty"`
-	Reviewed     bool       `gorm:"reviewed" json:"reviewed,omitempty"`
-	TimeReviewed *time.Time `gorm:"time_reviewed" json:"time_reviewed,omitempty"`
-	Approved     bool       `gorm:"approved" json:"approved,omitempty"`
-	Content      *[]byte    `gorm:"-" json:"content,omitempty"`
+	ID              int        `gorm:"primaryKey" json:"id,omitempty"`
+	Platform        string     `gorm:"default:discord" json:"platform,omitempty"`
+	FileName        string     `gorm:"file_name" json:"file_name,omitempty"`
+	Path            string     `json:"path,omitempty"`
+	SourceURL       string     `json:"source_url,omitempty"`
+	ThumbPath       string     `json:"thumb_path,omitempty"`
+	MimeType        string     `json:"mime_type,omitempty"`
+	Size            int64      `json:"size,omitempty"`
+	Width           int        `json:"width,omitempty"`
+	Height          int        `json:"height,omitempty"`
+	Digest          string     `gorm:"index" json:"digest,omitempty"`
+	PHash           *int64     `json:"phash,omitempty"`
+	NearDuplicateOf *int       `json:"near_duplicate_of,omitempty"`
+	Sender          string     `gorm:"sender" json:"sender,omitempty"`
+	GuildID         string     `json:"guild_id,omitempty"`
+	ChannelID       string     `json:"channel_id,omitempty"`
+	MessageID       string     `gorm:"index" json:"message_id,omitempty"`
+	Sent            *time.Time `gorm:"sent" json:"sent,omitempty"`
+	Reviewed        bool       `gorm:"reviewed" json:"reviewed,omitempty"`
+	TimeReviewed    *time.Time `gorm:"time_reviewed" json:"time_reviewed,omitempty"`
+	Approved        bool       `gorm:"approved" json:"approved,omitempty"`
+	// Current votes of the reviewers, see reviewPolicy
+	Approvals  int `gorm:"default:0" json:"approvals"`
+	Rejections int `gorm:"default:0" json:"rejections"`
+	// Web app user reviewing the file from the queue, 0 if none
+	ClaimedBy          int        `gorm:"index;default:0" json:"claimed_by,omitempty"`
+	ClaimExpires       *time.Time `json:"claim_expires,omitempty"`
+	Upvotes            int        `json:"upvotes"`
+	Downvotes          int        `json:"downvotes"`
+	Score              int        `gorm:"index" json:"score"`
+	PublishedMessageID string     `json:"published_message_id,omitempty"`
+	PublishedAt        *time.Time `json:"published_at,omitempty"`
+	SourceDeleted      bool       `json:"source_deleted,omitempty"`
+	SourceDeletedAt    *time.Time `json:"source_deleted_at,omitempty"`
+	Hidden             bool       `gorm:"index" json:"hidden,omitempty"`
+	// Text of the source message and name of who sent it, for the search
+	MessageText string `json:"message_text,omitempty"`
+	SenderName  string `json:"sender_name,omitempty"`
+	// Proposed at ingest time, a moderator turns them into tags
+	SuggestedTags pq.StringArray `gorm:"type:text[]" json:"suggested_tags,omitempty"`
+	Tags          []Tag          `gorm:"many2many:file_tags" json:"tags,omitempty"`
+	Content       *[]byte        `gorm:"-" json:"content,omitempty"`
 }
 
-func migrateTables(db *gorm.DB) error {
-	err := db.AutoMigrate(&FileInfo{})
+func migrateTables(db *gorm.DB, defaultGuildID string) error {
+	err := db.AutoMigrate(&FileInfo{}, &ChannelCheckpoint{}, &Repost{}, &PendingDownload{}, &ReviewEvent{}, &Vote{}, &GuildConfig{}, &Tag{})
 	if err != nil {
 		return err
 	}
-	return nil
+	if err := migrateReposts(db); err != nil {
+		return err
+	}
+	if err := migrateReviewEvents(db); err != nil {
+		return err
+	}
+	if err := migrateFileGuilds(db, defaultGuildID); err != nil {
+		return err
+	}
+	return migrateSearch(db)
 }
 
-func checkFileExists(db *gorm.DB, file *FileInfo) bool {
-	result := db.Omit("Content").Where(&file).Find(&file)
-	if result.Error != nil {
-		panic(result.Error)
+// Files saved before guilds had their own configuration carry no
+// guild, they were posted in the default one. Without it the showcase
+// would never pick them.
+func migrateFileGuilds(db *gorm.DB, guildID string) error {
+	if guildID == "" {
+		return nil
 	}
-	if result.RowsAffected < 1 {
-		return false
+	return db.Model(&FileInfo{}).
+		Where("COALESCE(guild_id, '') = '' AND platform = ?", platformDiscord).
+		Update("guild_id", guildID).Error
+}
+
+// Nickname in the guild when set, the username otherwise
+func senderName(message *discordgo.Message) string {
+	if message.Member != nil && message.Member.Nick != "" {
+		return message.Member.Nick
 	}
-	return true
+	return message.Author.Username
 }
 
 // TODO: Multiple files
-func getMessageAttachment(message *discordgo.Message) []*FileInfo {
-	var attachments []*FileInfo
+// Download jobs for the attachments allowed by the policy, the
+// rejected ones are logged with the reason and skipped
+func getMessageAttachment(message *discordgo.Message, policy *mediaPolicy) []*PendingDownload {
+	var attachments []*PendingDownload
 	for _, attach := range message.Attachments {
-		res, err := http.Get(attach.URL)
-
+		err := policy.precheck(int64(attach.Size), attach.ContentType)
 		if err != nil {
-			log.Println("Can't download attachment from URL")
-			panic(err)
+			log.Printf("Rejected attachment %s of message ID %s: %v\n", attach.Filename, message.ID, err)
+			continue
 		}
 
-		defer res.Body.Close()
-
-		fileContent, err := io.ReadAll(res.Body)
-		if err != nil {
-			panic(err)
-		}
-		fmt.Printf("Read %d bytes from Response Body\n", len(fileContent))
-
-		file := &FileInfo{
+		attachments = append(attachments, &PendingDownload{
+			URL:          attach.URL,
 			FileName:     attach.Filename,
+			DeclaredType: attach.ContentType,
 			Sender:       message.Author.ID,
-			Sent:         &message.Timestamp,
-			Reviewed:     false,
-			TimeReviewed: nil,
-			Approved:     false,
-			Content:      &fileContent}
-
-		attachments = append(attachments, file)
+			GuildID:      message.GuildID,
+			ChannelID:    message.ChannelID,
+			MessageID:    message.ID,
+			Sent:         message.Timestamp,
+		})
 	}
 	return attachments
 }
 
-func getChannelMessages(botSession *discordgo.Session, conf *memeBotConf) []*discordgo.Message {
-	channels, err := botSession.GuildChannels(conf.guildId)
-	if err != nil {
-		panic(err)
-	}
-	for _, ch := range channels {
-		for _, obsId := range conf.observedChannels {
-			if ch.ID == obsId {
-				msg, err := botSession.ChannelMessages(ch.ID, 100, "", "", "")
-				if err != nil {
-					log.Println("Error in getting channel messages")
-				}
-				return msg
-			}
-		}
-	}
-	return nil
-}
-
-func getDbMessages(db *gorm.DB) []*FileInfo {
+func getDbMessages(db *gorm.DB, order string, tags []string) []*FileInfo {
 	var fileInfo []*FileInfo
-	tx := db.Find(&[]FileInfo{}).Scan(&fileInfo)
+	tx := withTags(db.Preload("Tags"), tags).Where("hidden = ?", false).Order(order).Find(&fileInfo)
 	// ont=/.Model(&FileInfo{}).Where("id =?", fileId).Updates(FileInfo{Reviewed: true, TimeReviewed: &time, Approved: approved})
 
 	if tx.Error != nil {
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"gorm.io/gorm"
+)
+
+// Bits of a difference hash, one per compared pixel pair
+const phashBits = 64
+
+// Difference hash (dHash) of an image: the picture is reduced to a 9x8
+// grayscale grid and every bit tells if a pixel is brighter than its
+// right neighbour. Recompressed or resized copies keep almost all bits.
+func perceptualHash(content []byte) (uint64, error) {
+	img, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return 0, err
+	}
+
+	const w, h = 9, 8
+	var grid [h][w]float64
+	bounds := img.Bounds()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			cell := image.Rect(
+				bounds.Min.X+x*bounds.Dx()/w,
+				bounds.Min.Y+y*bounds.Dy()/h,
+				bounds.Min.X+(x+1)*bounds.Dx()/w,
+				bounds.Min.Y+(y+1)*bounds.Dy()/h,
+			)
+			grid[y][x] = averageLuma(img, cell)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if grid[y][x] > grid[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// Average luminance of a region, sampled on a sparse grid so that
+// huge pictures don't cost more than small ones
+func averageLuma(img image.Image, cell image.Rectangle) float64 {
+	const samples = 4
+	stepX := max(cell.Dx()/samples, 1)
+	stepY := max(cell.Dy()/samples, 1)
+
+	var sum float64
+	var n int
+	for y := cell.Min.Y; y < max(cell.Max.Y, cell.Min.Y+1); y += stepY {
+		for x := cell.Min.X; x < max(cell.Max.X, cell.Min.X+1); x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			n++
+		}
+	}
+	return sum / float64(n)
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Differing bits between the stored hash and the argument, counted by
+// Postgres so the hashes don't have to be loaded
+const hashDistanceExpr = `length(replace(((p_hash # ?)::bit(64))::text, '0', ''))`
+
+// Returns the stored file whose hash is the closest to the given one,
+// nil if none reaches the threshold
+func findSimilar(db *gorm.DB, hash uint64, threshold float64) (*FileInfo, float64, error) {
+	maxDistance := int((1 - threshold) * phashBits)
+	var match struct {
+		ID       int
+		Distance int
+	}
+	tx := db.Raw(`SELECT id, `+hashDistanceExpr+` AS distance FROM file_infos
+		WHERE p_hash IS NOT NULL AND `+hashDistanceExpr+` <= ?
+		ORDER BY distance, id
+		LIMIT 1`, int64(hash), int64(hash), maxDistance).
+		Scan(&match)
+	if tx.Error != nil {
+		return nil, 0, tx.Error
+	}
+	if tx.RowsAffected < 1 {
+		return nil, 0, nil
+	}
+
+	var original FileInfo
+	tx = db.Omit("Content").First(&original, match.ID)
+	if tx.Error != nil {
+		return nil, 0, tx.Error
+	}
+	return &original, 1 - float64(match.Distance)/phashBits, nil
+}
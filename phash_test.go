@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"math/bits"
+	"testing"
+)
+
+// Default similarity of the repost detection
+var testSimilarity = 0.9
+
+// Smooth waves, the frequencies make different pictures
+func testPicture(width int, height int, fx float64, fy float64) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			u, v := float64(x)/float64(width), float64(y)/float64(height)
+			luma := 128 + 100*math.Sin(u*fx*math.Pi)*math.Cos(v*fy*math.Pi)
+			img.Set(x, y, color.RGBA{uint8(luma), uint8(luma * 0.8), uint8(255 - luma), 255})
+		}
+	}
+	return img
+}
+
+func encodeJPEG(t *testing.T, img image.Image, quality int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPerceptualHash(t *testing.T) {
+	original := testPicture(640, 480, 3, 2)
+	hash := func(content []byte) uint64 {
+		t.Helper()
+		h, err := perceptualHash(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	want := hash(encodePNG(t, original))
+	maxDistance := int((1 - testSimilarity) * phashBits)
+
+	resized := image.NewRGBA(image.Rect(0, 0, 200, 150))
+	scaleDown(resized, original)
+	copies := map[string][]byte{
+		"recompressed":     encodeJPEG(t, original, 30),
+		"resized":          encodePNG(t, resized),
+		"resized and jpeg": encodeJPEG(t, resized, 50),
+		"stretched":        encodePNG(t, testPicture(800, 300, 3, 2)),
+	}
+	for name, content := range copies {
+		if distance := bits.OnesCount64(hash(content) ^ want); distance > maxDistance {
+			t.Errorf("%s copy %d bits away, over %d", name, distance, maxDistance)
+		}
+	}
+
+	others := map[string][]byte{
+		"other waves": encodePNG(t, testPicture(640, 480, 2, 5)),
+		"mirrored":    encodePNG(t, testPicture(640, 480, -3, 2)),
+		"pattern":     testPNG(1),
+	}
+	for name, content := range others {
+		if distance := bits.OnesCount64(hash(content) ^ want); distance <= maxDistance {
+			t.Errorf("%s picture only %d bits away", name, distance)
+		}
+	}
+
+	if _, err := perceptualHash([]byte("not a picture")); err == nil {
+		t.Error("hashed some text")
+	}
+}
+
+func TestFindSimilar(t *testing.T) {
+	db := testDB(t)
+	original := testPicture(640, 480, 3, 2)
+	hashes := map[string][]byte{
+		"a.png": encodePNG(t, original),
+		"b.png": encodePNG(t, testPicture(640, 480, 2, 5)),
+	}
+	files := map[string]*FileInfo{}
+	for name, content := range hashes {
+		hash, err := perceptualHash(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed := int64(hash)
+		file := &FileInfo{FileName: name, Digest: name, PHash: &signed}
+		if err := db.Omit("Content").Create(file).Error; err != nil {
+			t.Fatal(err)
+		}
+		files[name] = file
+	}
+
+	hash, _ := perceptualHash(encodeJPEG(t, original, 30))
+	similar, similarity, err := findSimilar(db, hash, testSimilarity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if similar == nil || similar.ID != files["a.png"].ID || similarity < testSimilarity {
+		t.Errorf("got %v, %.2f similar, want a.png", similar, similarity)
+	}
+
+	hash, _ = perceptualHash(testPNG(1))
+	if similar, _, _ := findSimilar(db, hash, testSimilarity); similar != nil {
+		t.Errorf("unrelated picture similar to %s", similar.FileName)
+	}
+}
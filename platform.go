@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// What the bot needs from the chat it archives, events and messages
+// keep the discordgo types so handlers don't need to convert them.
+// Handlers are funcs taking the event only, eg: func(*discordgo.MessageCreate)
+type chatPlatform interface {
+	Open() error
+	Close() error
+	// ID of the bot user, to ignore its own messages and reactions
+	UserID() string
+	AddHandler(handler interface{})
+
+	SendMessage(channelID string, message *discordgo.MessageSend) (*discordgo.Message, error)
+	AddReaction(channelID string, messageID string, emoji string) error
+	// Removes the reaction added by the bot
+	RemoveReaction(channelID string, messageID string, emoji string) error
+	// Up to limit messages before or after the given IDs, newest first
+	ChannelMessages(channelID string, limit int, before string, after string) ([]*discordgo.Message, error)
+	ChannelMessage(channelID string, messageID string) (*discordgo.Message, error)
+	// Users who reacted with the emoji, sorted by ID
+	MessageReactions(channelID string, messageID string, emoji string, limit int, after string) ([]*discordgo.User, error)
+	GuildChannels(guildID string) ([]*discordgo.Channel, error)
+	Channel(channelID string) (*discordgo.Channel, error)
+	ChannelPermissions(userID string, channelID string) (int64, error)
+
+	RegisterCommands(guildID string, commands []*discordgo.ApplicationCommand) error
+	RespondInteraction(interaction *discordgo.Interaction, response *discordgo.InteractionResponse) error
+}
+
+type discordPlatform struct {
+	session *discordgo.Session
+}
+
+func newDiscordPlatform(token string) (*discordPlatform, error) {
+	session, err := discordgo.New(fmt.Sprintf("Bot %s", token))
+	if err != nil {
+		return nil, err
+	}
+	// Links are read from the message text
+	session.Identify.Intents |= discordgo.IntentsMessageContent
+	return &discordPlatform{session: session}, nil
+}
+
+func (d *discordPlatform) Open() error {
+	return d.session.Open()
+}
+
+func (d *discordPlatform) Close() error {
+	return d.session.Close()
+}
+
+func (d *discordPlatform) UserID() string {
+	if d.session.State.User == nil {
+		return ""
+	}
+	return d.session.State.User.ID
+}
+
+// discordgo picks the event from the handler signature, so each kind
+// needs its own wrapper
+func (d *discordPlatform) AddHandler(handler interface{}) {
+	switch h := handler.(type) {
+	case func(*discordgo.MessageCreate):
+		d.session.AddHandler(func(_ *discordgo.Session, e *discordgo.MessageCreate) { h(e) })
+	case func(*discordgo.MessageUpdate):
+		d.session.AddHandler(func(_ *discordgo.Session, e *discordgo.MessageUpdate) { h(e) })
+	case func(*discordgo.MessageDelete):
+		d.session.AddHandler(func(_ *discordgo.Session, e *discordgo.MessageDelete) { h(e) })
+	case func(*discordgo.MessageDeleteBulk):
+		d.session.AddHandler(func(_ *discordgo.Session, e *discordgo.MessageDeleteBulk) { h(e) })
+	case func(*discordgo.MessageReactionAdd):
+		d.session.AddHandler(func(_ *discordgo.Session, e *discordgo.MessageReactionAdd) { h(e) })
+	case func(*discordgo.MessageReactionRemove):
+		d.session.AddHandler(func(_ *discordgo.Session, e *discordgo.MessageReactionRemove) { h(e) })
+	case func(*discordgo.InteractionCreate):
+		d.session.AddHandler(func(_ *discordgo.Session, e *discordgo.InteractionCreate) { h(e) })
+	default:
+		panic(fmt.Sprintf("unsupported handler %T", handler))
+	}
+}
+
+func (d *discordPlatform) SendMessage(channelID string, message *discordgo.MessageSend) (*discordgo.Message, error) {
+	return d.session.ChannelMessageSendComplex(channelID, message)
+}
+
+func (d *discordPlatform) AddReaction(channelID string, messageID string, emoji string) error {
+	return d.session.MessageReactionAdd(channelID, messageID, emoji)
+}
+
+func (d *discordPlatform) RemoveReaction(channelID string, messageID string, emoji string) error {
+	return d.session.MessageReactionRemove(channelID, messageID, emoji, "@me")
+}
+
+func (d *discordPlatform) ChannelMessages(channelID string, limit int, before string, after string) ([]*discordgo.Message, error) {
+	return d.session.ChannelMessages(channelID, limit, before, after, "")
+}
+
+func (d *discordPlatform) ChannelMessage(channelID string, messageID string) (*discordgo.Message, error) {
+	return d.session.ChannelMessage(channelID, messageID)
+}
+
+func (d *discordPlatform) MessageReactions(channelID string, messageID string, emoji string, limit int, after string) ([]*discordgo.User, error) {
+	return d.session.MessageReactions(channelID, messageID, emoji, limit, "", after)
+}
+
+func (d *discordPlatform) GuildChannels(guildID string) ([]*discordgo.Channel, error) {
+	return d.session.GuildChannels(guildID)
+}
+
+// From the state when cached, asked to Discord otherwise
+func (d *discordPlatform) Channel(channelID string) (*discordgo.Channel, error) {
+	if channel, err := d.session.State.Channel(channelID); err == nil {
+		return channel, nil
+	}
+	return d.session.Channel(channelID)
+}
+
+func (d *discordPlatform) ChannelPermissions(userID string, channelID string) (int64, error) {
+	return d.session.State.UserChannelPermissions(userID, channelID)
+}
+
+func (d *discordPlatform) RegisterCommands(guildID string, commands []*discordgo.ApplicationCommand) error {
+	_, err := d.session.ApplicationCommandBulkOverwrite(d.UserID(), guildID, commands)
+	return err
+}
+
+func (d *discordPlatform) RespondInteraction(interaction *discordgo.Interaction, response *discordgo.InteractionResponse) error {
+	return d.session.InteractionRespond(interaction, response)
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// In memory chat platform for the tests, events are fed with Dispatch
+// and what the bot sends back is recorded
+type fakePlatform struct {
+	mu          sync.Mutex
+	userID      string
+	handlers    []interface{}
+	channels    map[string][]*discordgo.Channel
+	messages    map[string][]*discordgo.Message
+	reactions   map[string]map[string][]string
+	permissions map[string]int64
+	lastID      uint64
+
+	// What the bot did, in order
+	Pages     []fakePage
+	Sent      []*discordgo.Message
+	Responses []*discordgo.InteractionResponse
+	Commands  map[string][]*discordgo.ApplicationCommand
+}
+
+// A ChannelMessages request
+type fakePage struct {
+	ChannelID string
+	Before    string
+	After     string
+}
+
+func newFakePlatform(userID string) *fakePlatform {
+	return &fakePlatform{
+		userID:      orDefault(userID, "1"),
+		channels:    make(map[string][]*discordgo.Channel),
+		messages:    make(map[string][]*discordgo.Message),
+		reactions:   make(map[string]map[string][]string),
+		permissions: make(map[string]int64),
+		Commands:    make(map[string][]*discordgo.ApplicationCommand),
+		// Discord epoch, IDs of sent messages are newer than the scripted ones
+		lastID: uint64(time.Now().UnixMilli()-1420070400000) << 22,
+	}
+}
+
+// Adds a channel to a guild, for GuildChannels and Channel
+func (f *fakePlatform) AddChannel(guildID string, channel *discordgo.Channel) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	channel.GuildID = guildID
+	f.channels[guildID] = append(f.channels[guildID], channel)
+}
+
+// Adds a message to the history without notifying the handlers, as if
+// it was posted while the bot was offline
+func (f *fakePlatform) AddMessage(message *discordgo.Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.store(message)
+}
+
+func (f *fakePlatform) Open() error {
+	return nil
+}
+
+func (f *fakePlatform) Close() error {
+	return nil
+}
+
+func (f *fakePlatform) UserID() string {
+	return f.userID
+}
+
+func (f *fakePlatform) AddHandler(handler interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handlers = append(f.handlers, handler)
+}
+
+// Applies the event to the fake state, the way Discord would, then
+// calls the handlers registered for it
+func (f *fakePlatform) Dispatch(event interface{}) {
+	f.mu.Lock()
+	switch e := event.(type) {
+	case *discordgo.MessageCreate:
+		f.store(e.Message)
+	case *discordgo.MessageUpdate:
+		f.store(e.Message)
+	case *discordgo.MessageDelete:
+		f.remove(e.ChannelID, e.ID)
+	case *discordgo.MessageReactionAdd:
+		f.react(e.MessageReaction, true)
+	case *discordgo.MessageReactionRemove:
+		f.react(e.MessageReaction, false)
+	}
+	handlers := append([]interface{}(nil), f.handlers...)
+	f.mu.Unlock()
+
+	for _, handler := range handlers {
+		switch h := handler.(type) {
+		case func(*discordgo.MessageCreate):
+			if e, ok := event.(*discordgo.MessageCreate); ok {
+				h(e)
+			}
+		case func(*discordgo.MessageUpdate):
+			if e, ok := event.(*discordgo.MessageUpdate); ok {
+				h(e)
+			}
+		case func(*discordgo.MessageDelete):
+			if e, ok := event.(*discordgo.MessageDelete); ok {
+				h(e)
+			}
+		case func(*discordgo.MessageDeleteBulk):
+			if e, ok := event.(*discordgo.MessageDeleteBulk); ok {
+				h(e)
+			}
+		case func(*discordgo.MessageReactionAdd):
+			if e, ok := event.(*discordgo.MessageReactionAdd); ok {
+				h(e)
+			}
+		case func(*discordgo.MessageReactionRemove):
+			if e, ok := event.(*discordgo.MessageReactionRemove); ok {
+				h(e)
+			}
+		case func(*discordgo.InteractionCreate):
+			if e, ok := event.(*discordgo.InteractionCreate); ok {
+				h(e)
+			}
+		}
+	}
+}
+
+// Adds or replaces a message in its channel, kept sorted by ID
+func (f *fakePlatform) store(message *discordgo.Message) {
+	if message == nil || message.ID == "" {
+		return
+	}
+	messages := f.messages[message.ChannelID]
+	for i, stored := range messages {
+		if stored.ID == message.ID {
+			messages[i] = message
+			return
+		}
+	}
+	messages = append(messages, message)
+	sortMessages(messages)
+	f.messages[message.ChannelID] = messages
+}
+
+func (f *fakePlatform) remove(channelID string, messageID string) {
+	messages := f.messages[channelID]
+	for i, stored := range messages {
+		if stored.ID == messageID {
+			f.messages[channelID] = append(messages[:i], messages[i+1:]...)
+			return
+		}
+	}
+}
+
+func (f *fakePlatform) find(channelID string, messageID string) *discordgo.Message {
+	for _, message := range f.messages[channelID] {
+		if message.ID == messageID {
+			return message
+		}
+	}
+	return nil
+}
+
+// Keeps both the users of each reaction and the counts on the message
+func (f *fakePlatform) react(reaction *discordgo.MessageReaction, added bool) {
+	emoji := reaction.Emoji.APIName()
+	byEmoji := f.reactions[reaction.MessageID]
+	if byEmoji == nil {
+		byEmoji = make(map[string][]string)
+		f.reactions[reaction.MessageID] = byEmoji
+	}
+	users := byEmoji[emoji]
+	found := -1
+	for i, user := range users {
+		if user == reaction.UserID {
+			found = i
+		}
+	}
+	switch {
+	case added && found < 0:
+		users = append(users, reaction.UserID)
+		sort.Slice(users, func(i, j int) bool { return snowflakeLess(users[i], users[j]) })
+	case !added && found >= 0:
+		users = append(users[:found], users[found+1:]...)
+	default:
+		return
+	}
+	byEmoji[emoji] = users
+
+	message := f.find(reaction.ChannelID, reaction.MessageID)
+	if message == nil {
+		return
+	}
+	for i, counted := range message.Reactions {
+		if counted.Emoji.APIName() == emoji {
+			counted.Count = len(users)
+			if counted.Count == 0 {
+				message.Reactions = append(message.Reactions[:i], message.Reactions[i+1:]...)
+			}
+			return
+		}
+	}
+	emojiCopy := reaction.Emoji
+	message.Reactions = append(message.Reactions, &discordgo.MessageReactions{Count: len(users), Emoji: &emojiCopy})
+}
+
+func (f *fakePlatform) nextID() string {
+	f.lastID += 1 << 22
+	return strconv.FormatUint(f.lastID, 10)
+}
+
+func (f *fakePlatform) SendMessage(channelID string, send *discordgo.MessageSend) (*discordgo.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	message := &discordgo.Message{
+		ID:        f.nextID(),
+		ChannelID: channelID,
+		Content:   send.Content,
+		Author:    &discordgo.User{ID: f.userID, Bot: true},
+		Timestamp: time.Now(),
+	}
+	if send.Reference != nil {
+		message.MessageReference = send.Reference
+	}
+	for _, file := range send.Files {
+		message.Attachments = append(message.Attachments, &discordgo.MessageAttachment{
+			ID:          f.nextID(),
+			Filename:    file.Name,
+			ContentType: file.ContentType,
+		})
+	}
+	f.store(message)
+	f.Sent = append(f.Sent, message)
+	return message, nil
+}
+
+func (f *fakePlatform) AddReaction(channelID string, messageID string, emoji string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.react(&discordgo.MessageReaction{
+		UserID:    f.userID,
+		MessageID: messageID,
+		ChannelID: channelID,
+		Emoji:     discordgo.Emoji{Name: emoji},
+	}, true)
+	return nil
+}
+
+func (f *fakePlatform) RemoveReaction(channelID string, messageID string, emoji string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.react(&discordgo.MessageReaction{
+		UserID:    f.userID,
+		MessageID: messageID,
+		ChannelID: channelID,
+		Emoji:     discordgo.Emoji{Name: emoji},
+	}, false)
+	return nil
+}
+
+// Same paging as Discord: the messages right after "after", otherwise
+// the ones right before "before" or the latest
+func (f *fakePlatform) ChannelMessages(channelID string, limit int, before string, after string) ([]*discordgo.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Pages = append(f.Pages, fakePage{ChannelID: channelID, Before: before, After: after})
+	var page []*discordgo.Message
+	messages := f.messages[channelID]
+	if after != "" {
+		for _, message := range messages {
+			if snowflakeLess(after, message.ID) && len(page) < limit {
+				// Newest first
+				page = append([]*discordgo.Message{message}, page...)
+			}
+		}
+		return page, nil
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		if (before == "" || snowflakeLess(messages[i].ID, before)) && len(page) < limit {
+			page = append(page, messages[i])
+		}
+	}
+	return page, nil
+}
+
+func (f *fakePlatform) ChannelMessage(channelID string, messageID string) (*discordgo.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if message := f.find(channelID, messageID); message != nil {
+		return message, nil
+	}
+	return nil, fmt.Errorf("unknown message %s", messageID)
+}
+
+func (f *fakePlatform) MessageReactions(channelID string, messageID string, emoji string, limit int, after string) ([]*discordgo.User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var users []*discordgo.User
+	for _, userID := range f.reactions[messageID][emoji] {
+		if (after == "" || snowflakeLess(after, userID)) && len(users) < limit {
+			users = append(users, &discordgo.User{ID: userID})
+		}
+	}
+	return users, nil
+}
+
+func (f *fakePlatform) GuildChannels(guildID string) ([]*discordgo.Channel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	channels, ok := f.channels[guildID]
+	if !ok {
+		return nil, fmt.Errorf("unknown guild %s", guildID)
+	}
+	return channels, nil
+}
+
+func (f *fakePlatform) Channel(channelID string) (*discordgo.Channel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, channels := range f.channels {
+		for _, channel := range channels {
+			if channel.ID == channelID {
+				return channel, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unknown channel %s", channelID)
+}
+
+func (f *fakePlatform) ChannelPermissions(userID string, channelID string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.permissions[userID], nil
+}
+
+func (f *fakePlatform) RegisterCommands(guildID string, commands []*discordgo.ApplicationCommand) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Commands[guildID] = commands
+	return nil
+}
+
+func (f *fakePlatform) RespondInteraction(interaction *discordgo.Interaction, response *discordgo.InteractionResponse) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Responses = append(f.Responses, response)
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// How long a moderator keeps the items handed out by the queue
+	claimDuration = 15 * time.Minute
+	// How often expired claims are cleared
+	claimSweepInterval = time.Minute
+	// Items handed out at once when no limit is requested, and the most allowed
+	queueDefaultLimit = 10
+	queueMaxLimit     = 50
+)
+
+// Returned when deciding on an item another moderator is reviewing
+var errClaimed = errors.New("file claimed by another moderator")
+
+// Claims the next unreviewed items for the user, oldest first. Items
+// already claimed by the user are handed out again with a new
+// expiry, the ones locked by a concurrent request or the user already
+// voted on are skipped.
+func claimNext(db *gorm.DB, userID int, limit int, now time.Time) ([]*FileInfo, error) {
+	var files []*FileInfo
+	expires := now.Add(claimDuration)
+	tx := db.Raw(`UPDATE file_infos SET claimed_by = ?, claim_expires = ?
+		WHERE id IN (
+			SELECT id FROM file_infos
+			WHERE reviewed = ? AND hidden = ? AND path <> ''
+				AND (claimed_by IN (0, ?) OR claim_expires IS NULL OR claim_expires < ?)
+				AND id NOT IN (
+					SELECT file_id FROM review_events
+					WHERE source = ? AND reviewer_id = ? AND undone = ? AND decision <> ?)
+			ORDER BY sent, id
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED)
+		RETURNING *`, userID, expires, false, false, userID, now,
+		sourceWeb, userID, false, decisionRevert, limit).
+		Scan(&files)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	// RETURNING doesn't keep the order of the subquery
+	sort.Slice(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if a.Sent == nil || b.Sent == nil || a.Sent.Equal(*b.Sent) {
+			return a.ID < b.ID
+		}
+		return a.Sent.Before(*b.Sent)
+	})
+	return files, nil
+}
+
+// Gives back the claims of the user on the files, or all of them when
+// no ID is given
+func releaseClaims(db *gorm.DB, userID int, fileIDs []int) (int64, error) {
+	tx := db.Model(&FileInfo{}).Where("claimed_by = ?", userID)
+	if len(fileIDs) > 0 {
+		tx = tx.Where("id IN ?", fileIDs)
+	}
+	tx = tx.Updates(map[string]interface{}{"claimed_by": 0, "claim_expires": nil})
+	return tx.RowsAffected, tx.Error
+}
+
+func sweepClaims(db *gorm.DB, now time.Time) (int64, error) {
+	tx := db.Model(&FileInfo{}).
+		Where("claimed_by <> ? AND claim_expires < ?", 0, now).
+		Updates(map[string]interface{}{"claimed_by": 0, "claim_expires": nil})
+	return tx.RowsAffected, tx.Error
+}
+
+// Clears the expired claims until the context is done, so the items
+// show up as unclaimed to everyone
+func runClaimSweeper(ctx context.Context, db *gorm.DB) {
+	ticker := time.NewTicker(claimSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		count, err := sweepClaims(db, time.Now())
+		if err != nil {
+			log.Println("Error releasing expired claims")
+			continue
+		}
+		if count > 0 {
+			log.Printf("Released %d expired claims\n", count)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Unreviewed files sent a minute apart, oldest first
+func createPending(t *testing.T, db *gorm.DB, count int) []*FileInfo {
+	t.Helper()
+	var files []*FileInfo
+	for i := 0; i < count; i++ {
+		sent := time.Date(2023, 3, 1, 12, i, 0, 0, time.UTC)
+		file := &FileInfo{FileName: fmt.Sprintf("%d.png", i), Digest: fmt.Sprint(i), Path: fmt.Sprintf("ab/%d.png", i), Sent: &sent}
+		if err := db.Omit("Content").Create(file).Error; err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+func fileIDs(files []*FileInfo) []int {
+	ids := make([]int, len(files))
+	for i, file := range files {
+		ids[i] = file.ID
+	}
+	return ids
+}
+
+func loadFile(t *testing.T, db *gorm.DB, id int) *FileInfo {
+	t.Helper()
+	var file FileInfo
+	if err := db.First(&file, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &file
+}
+
+func TestClaimExpiry(t *testing.T) {
+	db := testDB(t)
+	files := createPending(t, db, 3)
+	now := time.Now()
+
+	claimed, err := claimNext(db, 1, 2, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fileIDs(claimed); !reflect.DeepEqual(got, fileIDs(files[:2])) {
+		t.Fatalf("user 1 claimed %v", got)
+	}
+	// Claimed by someone else
+	claimed, _ = claimNext(db, 2, queueDefaultLimit, now)
+	if got := fileIDs(claimed); !reflect.DeepEqual(got, fileIDs(files[2:])) {
+		t.Fatalf("user 2 claimed %v", got)
+	}
+	// Handed out again to the holder, with a new expiry
+	claimed, _ = claimNext(db, 1, queueDefaultLimit, now.Add(time.Minute))
+	if len(claimed) != 2 || !claimed[0].ClaimExpires.After(now.Add(claimDuration)) {
+		t.Fatalf("claims of user 1 not renewed: %v", fileIDs(claimed))
+	}
+
+	// Expired claims go to whoever asks
+	later := now.Add(time.Minute + claimDuration + time.Second)
+	claimed, _ = claimNext(db, 2, queueDefaultLimit, later)
+	if got := fileIDs(claimed); !reflect.DeepEqual(got, fileIDs(files)) {
+		t.Fatalf("user 2 claimed %v after expiry", got)
+	}
+
+	count, err := releaseClaims(db, 2, []int{files[0].ID})
+	if err != nil || count != 1 {
+		t.Fatalf("released %d claims: %v", count, err)
+	}
+	// Only the expired ones are swept
+	db.Model(&FileInfo{}).Where("id = ?", files[1].ID).Update("claim_expires", now)
+	count, err = sweepClaims(db, later)
+	if err != nil || count != 1 {
+		t.Fatalf("swept %d claims: %v", count, err)
+	}
+	for i, holder := range []int{0, 0, 2} {
+		if file := loadFile(t, db, files[i].ID); file.ClaimedBy != holder {
+			t.Errorf("file %d claimed by %d, want %d", i, file.ClaimedBy, holder)
+		}
+	}
+}
+
+func TestClaimedDecisions(t *testing.T) {
+	db := testDB(t)
+	files := createPending(t, db, 2)
+	quorum := reviewPolicy{name: policyQuorum, quorum: 2, undoWindow: defaultUndoWindow}
+	holder := reviewer{userID: 1, source: sourceWeb}
+	other := reviewer{userID: 2, source: sourceWeb}
+
+	// Voted before the claim, taken back after
+	if err := reviewFile(db, quorum, files[0].ID, true, other, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := claimNext(db, holder.userID, queueDefaultLimit, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Decisions of others are rejected while the claim holds
+	err := reviewFile(db, quorum, files[1].ID, false, other, "")
+	if !errors.Is(err, errClaimed) {
+		t.Errorf("got %v deciding on a claimed file, want errClaimed", err)
+	}
+	discord := reviewer{discordID: "9", source: sourceDiscord}
+	if err := reviewFile(db, quorum, files[1].ID, true, discord, ""); !errors.Is(err, errClaimed) {
+		t.Errorf("got %v voting from Discord on a claimed file, want errClaimed", err)
+	}
+	if events, _ := reviewHistory(db, files[1].ID); len(events) != 0 {
+		t.Errorf("rejected decisions recorded: %d events", len(events))
+	}
+
+	// An undo by someone else leaves the claim alone
+	if _, err := undoReview(db, quorum, files[0].ID, other); err != nil {
+		t.Fatal(err)
+	}
+	if file := loadFile(t, db, files[0].ID); file.ClaimedBy != holder.userID || file.ClaimExpires == nil {
+		t.Errorf("claim released by someone else's undo: claimed by %d", file.ClaimedBy)
+	}
+
+	// The holder's vote releases it, even when not deciding yet
+	if err := reviewFile(db, quorum, files[0].ID, true, holder, ""); err != nil {
+		t.Fatal(err)
+	}
+	file := loadFile(t, db, files[0].ID)
+	if file.ClaimedBy != 0 || file.ClaimExpires != nil || file.Reviewed || file.Approvals != 1 {
+		t.Errorf("unexpected file after the holder's vote: claimed by %d, reviewed %v, %d approvals", file.ClaimedBy, file.Reviewed, file.Approvals)
+	}
+
+	// Once decided the claim is gone, whoever cast the deciding vote
+	if err := reviewFile(db, quorum, files[1].ID, true, holder, ""); err != nil {
+		t.Fatal(err)
+	}
+	db.Model(&FileInfo{}).Where("id = ?", files[1].ID).Updates(map[string]interface{}{"claimed_by": 3, "claim_expires": time.Now().Add(-time.Minute)})
+	if err := reviewFile(db, quorum, files[1].ID, true, other, ""); err != nil {
+		t.Fatal(err)
+	}
+	file = loadFile(t, db, files[1].ID)
+	if !file.Reviewed || !file.Approved || file.ClaimedBy != 0 {
+		t.Errorf("unexpected decided file: reviewed %v, approved %v, claimed by %d", file.Reviewed, file.Approved, file.ClaimedBy)
+	}
+}
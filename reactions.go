@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+// Reactions of the bot tell the state of the saved meme, moderators
+// react with the decision ones to review it from Discord
+const (
+	savedEmoji    = "💾"
+	approvedEmoji = "✅"
+	rejectedEmoji = "❌"
+)
+
+var stateEmojis = []string{savedEmoji, approvedEmoji, rejectedEmoji}
+
+func stateEmoji(file *FileInfo) string {
+	switch {
+	case !file.Reviewed:
+		return savedEmoji
+	case file.Approved:
+		return approvedEmoji
+	default:
+		return rejectedEmoji
+	}
+}
+
+// Files saved from the message, a message can carry more than one
+func filesByMessage(db *gorm.DB, messageID string) ([]*FileInfo, error) {
+	var files []*FileInfo
+	tx := db.Where("message_id = ?", messageID).Order("id").Find(&files)
+	return files, tx.Error
+}
+
+// Leaves on the source message only the bot reaction matching the
+// stored state, with more files the first one decides
+func (bot *memeBot) syncReactions(channelID string, messageID string) {
+	files, err := filesByMessage(bot.gorm, messageID)
+	if err != nil || len(files) == 0 {
+		return
+	}
+	wanted := stateEmoji(files[0])
+	for _, emoji := range stateEmojis {
+		if emoji == wanted {
+			continue
+		}
+		err := bot.platform.RemoveReaction(channelID, messageID, emoji)
+		if err != nil {
+			log.Printf("Error removing %s from message ID: %s\n", emoji, messageID)
+		}
+	}
+	err = bot.platform.AddReaction(channelID, messageID, wanted)
+	if err != nil {
+		log.Println("Error in adding reaction to message")
+		return
+	}
+	log.Printf("Reacted with %s to message ID: %s\n", wanted, messageID)
+}
+
+// Called after a review made outside Discord
+func (bot *memeBot) fileReviewed(fileID int) {
+	var file FileInfo
+	tx := bot.gorm.Limit(1).Find(&file, fileID)
+	if tx.Error != nil || tx.RowsAffected < 1 || file.MessageID == "" {
+		return
+	}
+	bot.syncReactions(file.ChannelID, file.MessageID)
+}
+
+func (bot *memeBot) reactionAddHandler(reaction *discordgo.MessageReactionAdd) {
+	if reaction.UserID == bot.platform.UserID() {
+		return
+	}
+	if value := bot.voteValue(reaction.ChannelID, reaction.Emoji); value != 0 {
+		bot.addVote(reaction.ChannelID, reaction.MessageID, reaction.UserID, value)
+		return
+	}
+	emoji := reaction.Emoji.Name
+	if emoji != approvedEmoji && emoji != rejectedEmoji {
+		return
+	}
+	if bot.guilds.forChannel(reaction.ChannelID) == nil {
+		return
+	}
+	if !bot.isModerator(reaction.Member, reaction.GuildID, reaction.ChannelID) {
+		return
+	}
+
+	files, err := filesByMessage(bot.gorm, reaction.MessageID)
+	if err != nil {
+		log.Println("Error getting files of message")
+		return
+	}
+	by := reviewer{discordID: reaction.UserID, source: sourceDiscord}
+	for _, file := range files {
+		err := reviewFile(bot.gorm, bot.conf.review, file.ID, emoji == approvedEmoji, by, "")
+		if errors.Is(err, errClaimed) {
+			log.Printf("File ID %d is claimed on the web app, reaction ignored\n", file.ID)
+			continue
+		}
+		if err != nil {
+			log.Printf("Error reviewing file ID %d from reaction\n", file.ID)
+			continue
+		}
+		log.Printf("[%s] Reviewed post %d with %s\n", reaction.UserID, file.ID, emoji)
+	}
+	if len(files) > 0 {
+		bot.syncReactions(reaction.ChannelID, reaction.MessageID)
+	}
+}
+
+// Removing the reaction takes the decision back, only if it's still
+// the last one taken and it was taken by the same moderator
+func (bot *memeBot) reactionRemoveHandler(reaction *discordgo.MessageReactionRemove) {
+	if reaction.UserID == bot.platform.UserID() {
+		return
+	}
+	if value := bot.voteValue(reaction.ChannelID, reaction.Emoji); value != 0 {
+		bot.removeVote(reaction.ChannelID, reaction.MessageID, reaction.UserID, value)
+		return
+	}
+	emoji := reaction.Emoji.Name
+	if emoji != approvedEmoji && emoji != rejectedEmoji {
+		return
+	}
+	if bot.guilds.forChannel(reaction.ChannelID) == nil {
+		return
+	}
+
+	files, err := filesByMessage(bot.gorm, reaction.MessageID)
+	if err != nil {
+		log.Println("Error getting files of message")
+		return
+	}
+	decision := decisionReject
+	if emoji == approvedEmoji {
+		decision = decisionApprove
+	}
+	by := reviewer{discordID: reaction.UserID, source: sourceDiscord}
+	reverted := false
+	for _, file := range files {
+		last, err := lastReviewerEvent(bot.gorm, file.ID, by)
+		if err != nil || last == nil || last.Decision != decision {
+			continue
+		}
+		err = revertReview(bot.gorm, bot.conf.review, file.ID, by)
+		if err != nil {
+			log.Printf("Error reverting review of file ID %d\n", file.ID)
+			continue
+		}
+		reverted = true
+		log.Printf("[%s] Reverted review of post %d\n", reaction.UserID, file.ID)
+	}
+	if reverted {
+		bot.syncReactions(reaction.ChannelID, reaction.MessageID)
+	}
+}
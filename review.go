@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	decisionApprove = "approve"
+	decisionReject  = "reject"
+	// A moderator took back their vote
+	decisionRevert = "revert"
+)
+
+const (
+	sourceWeb     = "web"
+	sourceDiscord = "discord"
+	// Auto approval by community score
+	sourceVotes = "votes"
+	// Decision taken before the events were recorded
+	sourceLegacy = "legacy"
+)
+
+const (
+	// The latest vote is the one that counts
+	policySingle = "single"
+	// Approved once enough reviewers approve, rejected once as many reject
+	policyQuorum = "quorum"
+	// Decided by the majority of a panel of reviewers
+	policyMajority = "majority"
+)
+
+const (
+	// Default time a reviewer has to undo a decision
+	defaultUndoWindow = 5 * time.Minute
+	// Longer reasons are cut
+	maxReasonLength = 500
+)
+
+var (
+	// Undo of a decision taken by someone else
+	errNotReviewer = errors.New("decision taken by another reviewer")
+	// Undo requested after the window, or with nothing to undo
+	errUndoExpired = errors.New("nothing to undo")
+)
+
+// Audit trail of every review, who decided what and from where. Each
+// reviewer has a vote on the file, their latest event not undone, and
+// the policy decides the review state from the votes.
+type ReviewEvent struct {
+	ID     int `gorm:"primaryKey" json:"id"`
+	FileID int `gorm:"index" json:"file_id"`
+	// Web app user, 0 when reviewed from Discord
+	ReviewerID    int    `json:"reviewer_id,omitempty"`
+	DiscordUserID string `json:"discord_user_id,omitempty"`
+	Source        string `json:"source"`
+	// Taken by a web app admin, whose rejections can veto
+	Admin     bool       `gorm:"default:false" json:"admin,omitempty"`
+	Decision  string     `json:"decision"`
+	Reason    string     `json:"reason,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	Undone    bool       `gorm:"default:false" json:"undone,omitempty"`
+	UndoneAt  *time.Time `json:"undone_at,omitempty"`
+}
+
+// Files reviewed before the events existed get one with their
+// decision, so their history isn't empty and the next vote on them
+// doesn't forget it. Their tally is set to that single vote.
+func migrateReviewEvents(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`INSERT INTO review_events (file_id, reviewer_id, discord_user_id, source, admin, decision, reason, created_at, undone)
+			SELECT id, 0, '', ?, false, CASE WHEN approved THEN ? ELSE ? END, '', COALESCE(time_reviewed, NOW()), false
+			FROM file_infos
+			WHERE reviewed AND NOT EXISTS (SELECT 1 FROM review_events WHERE review_events.file_id = file_infos.id)`,
+			sourceLegacy, decisionApprove, decisionReject).Error
+		if err != nil {
+			return err
+		}
+		return tx.Exec(`UPDATE file_infos SET
+				approvals = CASE WHEN approved THEN 1 ELSE 0 END,
+				rejections = CASE WHEN approved THEN 0 ELSE 1 END
+			WHERE reviewed AND approvals = 0 AND rejections = 0
+			AND id IN (SELECT file_id FROM review_events WHERE source = ?)`, sourceLegacy).Error
+	})
+}
+
+type reviewPolicy struct {
+	// single, quorum or majority
+	name string
+	// Approvals (or rejections) needed with the quorum policy
+	quorum int
+	// Reviewers voting with the majority policy, ties reject
+	panel int
+	// A rejection by any admin rejects the file, whatever the votes
+	adminVeto bool
+	// How long reviewers can take back their decisions
+	undoWindow time.Duration
+}
+
+func (policy reviewPolicy) validate() error {
+	switch policy.name {
+	case policySingle:
+	case policyQuorum:
+		if policy.quorum < 1 {
+			return errors.New("quorum must be at least 1")
+		}
+	case policyMajority:
+		if policy.panel < 1 {
+			return errors.New("panel must be at least 1")
+		}
+	default:
+		return fmt.Errorf("unknown review policy %q", policy.name)
+	}
+	return nil
+}
+
+// Votes counted on a file, one per reviewer
+type reviewTally struct {
+	approvals  int
+	rejections int
+	// Latest vote, and the latest admin rejection
+	last *ReviewEvent
+	veto *ReviewEvent
+}
+
+// Keeps the latest vote of each reviewer, reverted votes don't count
+// and undone events are skipped. Events have to be sorted oldest first.
+func tallyVotes(events []*ReviewEvent) reviewTally {
+	votes := make(map[string]*ReviewEvent)
+	for _, event := range events {
+		if event.Undone {
+			continue
+		}
+		votes[fmt.Sprintf("%s/%d/%s", event.Source, event.ReviewerID, event.DiscordUserID)] = event
+	}
+
+	var tally reviewTally
+	for _, vote := range votes {
+		switch vote.Decision {
+		case decisionApprove:
+			tally.approvals++
+		case decisionReject:
+			tally.rejections++
+			if vote.Admin && (tally.veto == nil || vote.ID > tally.veto.ID) {
+				tally.veto = vote
+			}
+		default:
+			continue
+		}
+		if tally.last == nil || vote.ID > tally.last.ID {
+			tally.last = vote
+		}
+	}
+	return tally
+}
+
+// Whether the votes decide the file and which way, dated with the
+// latest vote or with the veto
+func (policy reviewPolicy) decide(tally reviewTally) (reviewed bool, approved bool, at *time.Time) {
+	if policy.adminVeto && tally.veto != nil {
+		return true, false, &tally.veto.CreatedAt
+	}
+
+	switch policy.name {
+	case policyQuorum:
+		if tally.approvals >= policy.quorum {
+			return true, true, &tally.last.CreatedAt
+		}
+		if tally.rejections >= policy.quorum {
+			return true, false, &tally.last.CreatedAt
+		}
+	case policyMajority:
+		if tally.approvals > policy.panel/2 {
+			return true, true, &tally.last.CreatedAt
+		}
+		if tally.rejections >= policy.panel-policy.panel/2 {
+			return true, false, &tally.last.CreatedAt
+		}
+	default:
+		// Taking back the latest vote brings back the one before
+		if tally.last != nil {
+			return true, tally.last.Decision == decisionApprove, &tally.last.CreatedAt
+		}
+	}
+	return false, false, nil
+}
+
+type reviewer struct {
+	userID    int
+	discordID string
+	source    string
+	admin     bool
+}
+
+// Records the moderator decision on a file, shared by the web app and
+// the Discord commands and reactions
+func reviewFile(db *gorm.DB, policy reviewPolicy, fileID int, approved bool, by reviewer, reason string) error {
+	decision := decisionReject
+	if approved {
+		decision = decisionApprove
+	}
+	return recordReview(db, policy, fileID, decision, by, reason)
+}
+
+// Takes back the vote of the reviewer
+func revertReview(db *gorm.DB, policy reviewPolicy, fileID int, by reviewer) error {
+	return recordReview(db, policy, fileID, decisionRevert, by, "")
+}
+
+// Any decision releases the claim on the file, files claimed by
+// another moderator are left untouched and errClaimed returned
+func recordReview(db *gorm.DB, policy reviewPolicy, fileID int, decision string, by reviewer, reason string) error {
+	reason = strings.TrimSpace(reason)
+	if runes := []rune(reason); len(runes) > maxReasonLength {
+		reason = string(runes[:maxReasonLength])
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		file, err := lockFile(tx, fileID)
+		if err != nil {
+			return err
+		}
+		claimed := file.ClaimedBy != 0 && file.ClaimedBy != by.userID
+		if claimed && file.ClaimExpires != nil && file.ClaimExpires.After(time.Now()) {
+			return errClaimed
+		}
+
+		err = tx.Create(&ReviewEvent{
+			FileID:        fileID,
+			ReviewerID:    by.userID,
+			DiscordUserID: by.discordID,
+			Source:        by.source,
+			Admin:         by.admin,
+			Decision:      decision,
+			Reason:        reason,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return applyReviewState(tx, policy, file, by)
+	})
+}
+
+// Takes back the latest vote of the reviewer on a file, if it was
+// cast within the window
+func undoReview(db *gorm.DB, policy reviewPolicy, fileID int, by reviewer) (*ReviewEvent, error) {
+	var event *ReviewEvent
+	err := db.Transaction(func(tx *gorm.DB) error {
+		file, err := lockFile(tx, fileID)
+		if err != nil {
+			return err
+		}
+		event, err = lastReviewerEvent(tx, fileID, by)
+		if err != nil {
+			return err
+		}
+		if event == nil {
+			// Tell apart the files only someone else decided on
+			last, err := lastReviewEvent(tx, fileID)
+			if err != nil {
+				return err
+			}
+			if last != nil {
+				return errNotReviewer
+			}
+			return errUndoExpired
+		}
+		if time.Since(event.CreatedAt) > policy.undoWindow {
+			return errUndoExpired
+		}
+
+		now := time.Now()
+		event.Undone, event.UndoneAt = true, &now
+		err = tx.Model(event).Select("Undone", "UndoneAt").Updates(event).Error
+		if err != nil {
+			return err
+		}
+		return applyReviewState(tx, policy, file, by)
+	})
+	return event, err
+}
+
+// The review columns of the file, locked until the end of the
+// transaction so decisions on the same file are taken one at a time
+func lockFile(tx *gorm.DB, fileID int) (*FileInfo, error) {
+	var file FileInfo
+	res := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id", "claimed_by", "claim_expires").
+		Limit(1).
+		Find(&file, fileID)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected < 1 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &file, nil
+}
+
+// Rewrites the review columns and the tally of the file from its
+// events, they are kept on the file so listing and filtering don't
+// need the events. The claim is released once the file is decided or
+// by its holder, votes of anyone else leave it alone.
+func applyReviewState(tx *gorm.DB, policy reviewPolicy, file *FileInfo, by reviewer) error {
+	var events []*ReviewEvent
+	err := tx.Where("file_id = ? AND undone = ?", file.ID, false).Order("id").Find(&events).Error
+	if err != nil {
+		return err
+	}
+	tally := tallyVotes(events)
+	state := FileInfo{Approvals: tally.approvals, Rejections: tally.rejections}
+	state.Reviewed, state.Approved, state.TimeReviewed = policy.decide(tally)
+	columns := []string{"Reviewed", "TimeReviewed", "Approved", "Approvals", "Rejections"}
+	if state.Reviewed || (file.ClaimedBy != 0 && file.ClaimedBy == by.userID) {
+		columns = append(columns, "ClaimedBy", "ClaimExpires")
+	}
+	return tx.Model(&FileInfo{}).
+		Where("id = ?", file.ID).
+		Select(columns).
+		Updates(state).Error
+}
+
+// Most recent review event of a file not undone, nil if never reviewed
+func lastReviewEvent(db *gorm.DB, fileID int) (*ReviewEvent, error) {
+	return findLastEvent(db.Where("file_id = ? AND undone = ?", fileID, false))
+}
+
+// Most recent event of the reviewer on a file not undone, their vote
+func lastReviewerEvent(db *gorm.DB, fileID int, by reviewer) (*ReviewEvent, error) {
+	return findLastEvent(db.Where(
+		"file_id = ? AND undone = ? AND source = ? AND reviewer_id = ? AND discord_user_id = ?",
+		fileID, false, by.source, by.userID, by.discordID,
+	))
+}
+
+func findLastEvent(query *gorm.DB) (*ReviewEvent, error) {
+	var event ReviewEvent
+	tx := query.Order("id DESC").Limit(1).Find(&event)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if tx.RowsAffected < 1 {
+		return nil, nil
+	}
+	return &event, nil
+}
+
+// Every event of a file, oldest first, undone ones included
+func reviewHistory(db *gorm.DB, fileID int) ([]*ReviewEvent, error) {
+	events := []*ReviewEvent{}
+	tx := db.Where("file_id = ?", fileID).Order("id").Find(&events)
+	return events, tx.Error
+}
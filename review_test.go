@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMigrateReviewEvents(t *testing.T) {
+	db := testDB(t)
+	reviewed := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	approved := &FileInfo{FileName: "a.png", Digest: "a", Reviewed: true, Approved: true, TimeReviewed: &reviewed}
+	pending := &FileInfo{FileName: "b.png", Digest: "b"}
+	for _, file := range []*FileInfo{approved, pending} {
+		if err := db.Omit("Content").Create(file).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Run on every start
+	for i := 0; i < 2; i++ {
+		if err := migrateReviewEvents(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err := reviewHistory(db, approved.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	if e := events[0]; e.Source != sourceLegacy || e.Decision != decisionApprove || !e.CreatedAt.Equal(reviewed) {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if events, _ := reviewHistory(db, pending.ID); len(events) != 0 {
+		t.Errorf("got %d events for a file never reviewed", len(events))
+	}
+
+	// A rejection taken back brings back the legacy decision
+	policy := reviewPolicy{name: policySingle, undoWindow: defaultUndoWindow}
+	by := reviewer{userID: 1, source: sourceWeb}
+	if err := reviewFile(db, policy, approved.ID, false, by, "not funny"); err != nil {
+		t.Fatal(err)
+	}
+	if err := revertReview(db, policy, approved.ID, by); err != nil {
+		t.Fatal(err)
+	}
+	var file FileInfo
+	if err := db.First(&file, approved.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !file.Reviewed || !file.Approved || file.Approvals != 1 || file.Rejections != 0 {
+		t.Errorf("legacy decision lost: reviewed %v, approved %v, %d/%d", file.Reviewed, file.Approved, file.Approvals, file.Rejections)
+	}
+}
+
+// A vote of the reviewer "who" from Discord
+type testVote struct {
+	who      string
+	decision string
+	admin    bool
+	undone   bool
+}
+
+// Events numbered in order, a minute apart
+func testEvents(votes []testVote) []*ReviewEvent {
+	start := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	events := make([]*ReviewEvent, len(votes))
+	for i, vote := range votes {
+		events[i] = &ReviewEvent{
+			ID:            i + 1,
+			DiscordUserID: vote.who,
+			Source:        sourceDiscord,
+			Admin:         vote.admin,
+			Decision:      vote.decision,
+			CreatedAt:     start.Add(time.Duration(i) * time.Minute),
+			Undone:        vote.undone,
+		}
+	}
+	return events
+}
+
+func TestReviewPolicies(t *testing.T) {
+	single := reviewPolicy{name: policySingle}
+	quorum := reviewPolicy{name: policyQuorum, quorum: 2}
+	veto := reviewPolicy{name: policyQuorum, quorum: 2, adminVeto: true}
+	panel3 := reviewPolicy{name: policyMajority, panel: 3}
+	panel4 := reviewPolicy{name: policyMajority, panel: 4}
+	approve := func(who string) testVote { return testVote{who: who, decision: decisionApprove} }
+	reject := func(who string) testVote { return testVote{who: who, decision: decisionReject} }
+	revert := func(who string) testVote { return testVote{who: who, decision: decisionRevert} }
+
+	tests := []struct {
+		name       string
+		policy     reviewPolicy
+		votes      []testVote
+		reviewed   bool
+		approved   bool
+		approvals  int
+		rejections int
+		// Event dating the decision, 0 when undecided
+		at int
+	}{
+		{name: "single, no votes", policy: single},
+		{name: "single, approved", policy: single, votes: []testVote{approve("a")}, reviewed: true, approved: true, approvals: 1, at: 1},
+		{name: "single, changed vote", policy: single, votes: []testVote{approve("a"), reject("a")}, reviewed: true, rejections: 1, at: 2},
+		{name: "single, latest reviewer wins", policy: single, votes: []testVote{approve("a"), reject("b")}, reviewed: true, approvals: 1, rejections: 1, at: 2},
+		{name: "single, reverted vote", policy: single, votes: []testVote{approve("a"), reject("b"), revert("b")}, reviewed: true, approved: true, approvals: 1, at: 1},
+		{name: "single, undone vote", policy: single, votes: []testVote{approve("a"), {who: "b", decision: decisionReject, undone: true}}, reviewed: true, approved: true, approvals: 1, at: 1},
+		{name: "single, everything reverted", policy: single, votes: []testVote{approve("a"), revert("a")}},
+
+		{name: "quorum, one short", policy: quorum, votes: []testVote{approve("a")}, approvals: 1},
+		{name: "quorum, same reviewer twice", policy: quorum, votes: []testVote{approve("a"), approve("a")}, approvals: 1},
+		{name: "quorum, approved", policy: quorum, votes: []testVote{approve("a"), reject("b"), approve("c")}, reviewed: true, approved: true, approvals: 2, rejections: 1, at: 3},
+		{name: "quorum, rejected", policy: quorum, votes: []testVote{reject("a"), reject("b")}, reviewed: true, rejections: 2, at: 2},
+		{name: "quorum, changed vote", policy: quorum, votes: []testVote{approve("a"), approve("b"), reject("b")}, approvals: 1, rejections: 1},
+		{name: "quorum, undone vote", policy: quorum, votes: []testVote{approve("a"), {who: "b", decision: decisionApprove, undone: true}}, approvals: 1},
+
+		{name: "veto after approvals", policy: veto, votes: []testVote{approve("a"), approve("b"), {who: "c", decision: decisionReject, admin: true}}, reviewed: true, approvals: 2, rejections: 1, at: 3},
+		{name: "veto disabled", policy: quorum, votes: []testVote{approve("a"), approve("b"), {who: "c", decision: decisionReject, admin: true}}, reviewed: true, approved: true, approvals: 2, rejections: 1, at: 3},
+		{name: "veto taken back", policy: veto, votes: []testVote{approve("a"), approve("b"), {who: "c", decision: decisionReject, admin: true}, revert("c")}, reviewed: true, approved: true, approvals: 2, at: 2},
+		{name: "veto undone", policy: veto, votes: []testVote{approve("a"), {who: "c", decision: decisionReject, admin: true, undone: true}}, approvals: 1},
+		{name: "veto by a moderator", policy: veto, votes: []testVote{approve("a"), reject("c")}, approvals: 1, rejections: 1},
+
+		{name: "majority, approved", policy: panel3, votes: []testVote{approve("a"), approve("b")}, reviewed: true, approved: true, approvals: 2, at: 2},
+		{name: "majority, rejected", policy: panel3, votes: []testVote{reject("a"), approve("b"), reject("c")}, reviewed: true, approvals: 1, rejections: 2, at: 3},
+		{name: "majority, split", policy: panel3, votes: []testVote{approve("a"), reject("b")}, approvals: 1, rejections: 1},
+		{name: "majority, half approving", policy: panel4, votes: []testVote{approve("a"), approve("b")}, approvals: 2},
+		{name: "majority, tie rejects", policy: panel4, votes: []testVote{approve("a"), approve("b"), reject("c"), reject("d")}, reviewed: true, approvals: 2, rejections: 2, at: 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events := testEvents(test.votes)
+			tally := tallyVotes(events)
+			if tally.approvals != test.approvals || tally.rejections != test.rejections {
+				t.Errorf("got %d/%d votes, want %d/%d", tally.approvals, tally.rejections, test.approvals, test.rejections)
+			}
+			reviewed, approved, at := test.policy.decide(tally)
+			if reviewed != test.reviewed || approved != test.approved {
+				t.Errorf("got reviewed %v, approved %v", reviewed, approved)
+			}
+			switch {
+			case test.at == 0 && at != nil:
+				t.Errorf("undecided file dated %v", at)
+			case test.at != 0 && (at == nil || !at.Equal(events[test.at-1].CreatedAt)):
+				t.Errorf("got date %v, want the one of event %d", at, test.at)
+			}
+		})
+	}
+}
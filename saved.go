@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	savedDefaultLimit = 50
+	savedMaxLimit     = 200
+)
+
+// Sort options of the saved files. Every order ends with the ID so
+// the keyset cursor always points to a single row.
+type savedSort struct {
+	// Sorted column, NULLs replaced so they can be compared
+	expr string
+	// SQL type the cursor key is cast to
+	cast string
+	desc bool
+	key  func(file *FileInfo) string
+}
+
+var savedSorts = map[string]savedSort{
+	"": {
+		expr: "id", cast: "integer",
+		key: func(file *FileInfo) string { return strconv.Itoa(file.ID) },
+	},
+	"score": {
+		expr: "score", cast: "integer", desc: true,
+		key: func(file *FileInfo) string { return strconv.Itoa(file.Score) },
+	},
+	"sent": {
+		expr: "COALESCE(sent, '0001-01-01')", cast: "timestamptz", desc: true,
+		key: func(file *FileInfo) string { return timeKey(file.Sent) },
+	},
+	"reviewed": {
+		expr: "COALESCE(time_reviewed, '0001-01-01')", cast: "timestamptz", desc: true,
+		key: func(file *FileInfo) string { return timeKey(file.TimeReviewed) },
+	},
+}
+
+// Keys come back from the clients, a mangled one would only fail in SQL
+func (s savedSort) validKey(key string) bool {
+	var err error
+	switch s.cast {
+	case "integer":
+		_, err = strconv.Atoi(key)
+	case "timestamptz":
+		_, err = time.Parse(time.RFC3339Nano, key)
+	}
+	return err == nil
+}
+
+func timeKey(t *time.Time) string {
+	if t == nil {
+		return "0001-01-01T00:00:00Z"
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// Position after the last row of a page, opaque to the clients
+type savedCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   int    `json:"i"`
+}
+
+func (c *savedCursor) encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(value string) (*savedCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	var cursor savedCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	return &cursor, nil
+}
+
+// A page request of /saved, parsed from the query string
+type savedQuery struct {
+	sortName string
+	sort     savedSort
+	limit    int
+	cursor   *savedCursor
+
+	reviewed *bool
+	approved *bool
+	sender   string
+	channel  string
+	from     *time.Time
+	to       *time.Time
+	mime     string
+	tags     []string
+}
+
+func parseSavedQuery(values url.Values) (*savedQuery, error) {
+	query := &savedQuery{
+		sortName: values.Get("sort"),
+		limit:    savedDefaultLimit,
+		sender:   values.Get("sender"),
+		channel:  values.Get("channel"),
+		mime:     values.Get("mime"),
+		tags:     values["tag"],
+	}
+
+	var ok bool
+	query.sort, ok = savedSorts[query.sortName]
+	if !ok {
+		return nil, fmt.Errorf("unknown sort %q", query.sortName)
+	}
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > savedMaxLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d", savedMaxLimit)
+		}
+		query.limit = limit
+	}
+	if value := values.Get("cursor"); value != "" {
+		cursor, err := decodeCursor(value)
+		if err != nil {
+			return nil, err
+		}
+		// Keys of a sort mean nothing to another one
+		if cursor.Sort != query.sortName {
+			return nil, errors.New("cursor doesn't match the sort")
+		}
+		if cursor.ID < 1 || !query.sort.validKey(cursor.Key) {
+			return nil, errors.New("invalid cursor")
+		}
+		query.cursor = cursor
+	}
+
+	var err error
+	if query.reviewed, err = parseOptionalBool(values, "reviewed"); err != nil {
+		return nil, err
+	}
+	if query.approved, err = parseOptionalBool(values, "approved"); err != nil {
+		return nil, err
+	}
+	if query.from, err = parseDateParam(values, "from", false); err != nil {
+		return nil, err
+	}
+	if query.to, err = parseDateParam(values, "to", true); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+func parseOptionalBool(values url.Values, name string) (*bool, error) {
+	value := values.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be true or false", name)
+	}
+	return &parsed, nil
+}
+
+// RFC 3339 times or plain dates, an end date includes the whole day
+func parseDateParam(values url.Values, name string, end bool) (*time.Time, error) {
+	value := values.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a date or an RFC 3339 time", name)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
+}
+
+// The visible files matching the filters, one page at a time. The
+// cursor of the next page is nil on the last one.
+func listSaved(db *gorm.DB, query *savedQuery) ([]*FileInfo, *savedCursor, error) {
+	tx := withTags(db.Preload("Tags"), query.tags).Where("hidden = ?", false)
+	if query.reviewed != nil {
+		tx = tx.Where("reviewed = ?", *query.reviewed)
+	}
+	if query.approved != nil {
+		tx = tx.Where("approved = ?", *query.approved)
+	}
+	if query.sender != "" {
+		tx = tx.Where("(sender = ? OR LOWER(sender_name) = LOWER(?))", query.sender, query.sender)
+	}
+	if query.channel != "" {
+		tx = tx.Where("channel_id = ?", query.channel)
+	}
+	if query.from != nil {
+		tx = tx.Where("sent >= ?", *query.from)
+	}
+	if query.to != nil {
+		tx = tx.Where("sent < ?", *query.to)
+	}
+	// "image/" or "image/*" for a whole family
+	if family := strings.TrimSuffix(query.mime, "*"); len(family) > 1 && strings.HasSuffix(family, "/") {
+		tx = tx.Where("mime_type LIKE ?", escapeLike(family)+"%")
+	} else if query.mime != "" {
+		tx = tx.Where("mime_type = ?", query.mime)
+	}
+
+	sort := query.sort
+	direction, compare := "", ">"
+	if sort.desc {
+		direction, compare = " DESC", "<"
+	}
+	if query.cursor != nil {
+		tx = tx.Where(
+			fmt.Sprintf("(%s, id) %s (CAST(? AS %s), ?)", sort.expr, compare, sort.cast),
+			query.cursor.Key, query.cursor.ID,
+		)
+	}
+
+	// One more than asked, to know if there is a next page
+	var files []*FileInfo
+	err := tx.
+		Order(sort.expr + direction).
+		Order("id" + direction).
+		Limit(query.limit + 1).
+		Find(&files).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(files) <= query.limit {
+		return files, nil, nil
+	}
+	files = files[:query.limit]
+	last := files[len(files)-1]
+	return files, &savedCursor{Sort: query.sortName, Key: sort.key(last), ID: last.ID}, nil
+}
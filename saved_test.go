@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSavedCursor(t *testing.T) {
+	sent := time.Date(2023, 3, 1, 12, 0, 0, 5, time.FixedZone("CET", 3600))
+	file := &FileInfo{ID: 42, Score: -3, Sent: &sent}
+	for name, sort := range savedSorts {
+		cursor := &savedCursor{Sort: name, Key: sort.key(file), ID: file.ID}
+		query, err := parseSavedQuery(url.Values{"sort": {name}, "cursor": {cursor.encode()}})
+		if err != nil {
+			t.Errorf("sort %q: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(query.cursor, cursor) {
+			t.Errorf("sort %q: got %+v, want %+v", name, query.cursor, cursor)
+		}
+	}
+	// Files never reviewed sort as the oldest
+	if key := savedSorts["reviewed"].key(file); key != "0001-01-01T00:00:00Z" {
+		t.Errorf("got key %q for a missing time", key)
+	}
+
+	raw := func(json string) string { return base64.RawURLEncoding.EncodeToString([]byte(json)) }
+	tests := []struct {
+		name   string
+		sort   string
+		cursor string
+	}{
+		{name: "not base64", cursor: "%%%"},
+		{name: "padded base64", cursor: base64.URLEncoding.EncodeToString([]byte(`{"s":"","k":"1","i":1}`))},
+		{name: "not json", cursor: raw("cursor")},
+		{name: "wrong field type", cursor: raw(`{"s":"","k":"1","i":"1"}`)},
+		{name: "other sort", sort: "score", cursor: (&savedCursor{Sort: "sent", Key: timeKey(&sent), ID: 1}).encode()},
+		{name: "tampered integer key", sort: "score", cursor: raw(`{"s":"score","k":"1; DROP TABLE file_infos","i":1}`)},
+		{name: "tampered time key", sort: "sent", cursor: raw(`{"s":"sent","k":"yesterday","i":1}`)},
+		{name: "missing id", sort: "score", cursor: raw(`{"s":"score","k":"1"}`)},
+		{name: "negative id", cursor: raw(`{"s":"","k":"1","i":-1}`)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values := url.Values{"sort": {test.sort}, "cursor": {test.cursor}}
+			if query, err := parseSavedQuery(values); err == nil {
+				t.Errorf("accepted cursor %+v", query.cursor)
+			}
+		})
+	}
+}
+
+func TestParseSavedQuery(t *testing.T) {
+	query, err := parseSavedQuery(url.Values{
+		"limit": {"10"}, "reviewed": {"true"}, "approved": {"0"},
+		"from": {"2023-03-01"}, "to": {"2023-03-02"}, "tag": {"cat", "dog"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, to := time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 3, 3, 0, 0, 0, 0, time.UTC)
+	if query.limit != 10 || !*query.reviewed || *query.approved || !query.from.Equal(from) || !query.to.Equal(to) || len(query.tags) != 2 {
+		t.Errorf("unexpected query %+v", query)
+	}
+	if query, _ := parseSavedQuery(url.Values{}); query.limit != savedDefaultLimit || query.reviewed != nil || query.cursor != nil {
+		t.Errorf("unexpected default query %+v", query)
+	}
+
+	for _, values := range []url.Values{
+		{"sort": {"name"}},
+		{"limit": {"0"}},
+		{"limit": {fmt.Sprint(savedMaxLimit + 1)}},
+		{"reviewed": {"maybe"}},
+		{"from": {"March"}},
+	} {
+		if _, err := parseSavedQuery(values); err == nil {
+			t.Errorf("accepted %v", values)
+		}
+	}
+}
+
+// Files sharing a sort key are split across pages without repeats or gaps
+func TestSavedPagesWithTies(t *testing.T) {
+	db := testDB(t)
+	sent := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	scores := []int{5, 3, 3, 3, 3, 1, 3, 5}
+	for i, score := range scores {
+		file := &FileInfo{FileName: fmt.Sprintf("%d.png", i), Digest: fmt.Sprint(i), Score: score}
+		// Every other file without a date
+		if i%2 == 0 {
+			file.Sent = &sent
+		}
+		if err := db.Omit("Content").Create(file).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, sort := range []string{"", "score", "sent", "reviewed"} {
+		t.Run("sort "+sort, func(t *testing.T) {
+			var all []*FileInfo
+			cursor := ""
+			for page := 0; ; page++ {
+				query, err := parseSavedQuery(url.Values{"sort": {sort}, "limit": {"3"}, "cursor": {cursor}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				files, next, err := listSaved(db, query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				all = append(all, files...)
+				if next == nil {
+					break
+				}
+				if page > len(scores) {
+					t.Fatal("pages never end")
+				}
+				cursor = next.encode()
+			}
+
+			if len(all) != len(scores) {
+				t.Fatalf("got %d files over the pages, want %d", len(all), len(scores))
+			}
+			seen := map[int]bool{}
+			for i, file := range all {
+				if seen[file.ID] {
+					t.Errorf("file %d listed twice", file.ID)
+				}
+				seen[file.ID] = true
+				if i == 0 {
+					continue
+				}
+				prev := all[i-1]
+				if sort == "score" && (prev.Score < file.Score || prev.Score == file.Score && prev.ID < file.ID) {
+					t.Errorf("file %d (score %d) after file %d (score %d)", file.ID, file.Score, prev.ID, prev.Score)
+				}
+				if sort == "" && prev.ID > file.ID {
+					t.Errorf("file %d after file %d", file.ID, prev.ID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// No stemming, the community doesn't write in a single language
+	searchConfig = "simple"
+	// Results of a search when no limit is requested, and the most allowed
+	searchDefaultLimit = 50
+	searchMaxLimit     = 100
+)
+
+type searchResult struct {
+	File    *FileInfo `json:"file"`
+	Rank    float64   `json:"rank"`
+	Snippet string    `json:"snippet"`
+}
+
+// The search_vector column is kept by the bot rather than generated,
+// as tags live in another table. Rows saved before the column existed
+// are indexed once here.
+func migrateSearch(db *gorm.DB) error {
+	err := db.Exec(`ALTER TABLE file_infos ADD COLUMN IF NOT EXISTS search_vector tsvector`).Error
+	if err != nil {
+		return err
+	}
+	err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_file_infos_search ON file_infos USING GIN (search_vector)`).Error
+	if err != nil {
+		return err
+	}
+	return db.Exec(searchVectorUpdate + ` WHERE search_vector IS NULL`).Error
+}
+
+// Weighted by how much each field says about the meme: tags first,
+// then the message text, the file name and the sender
+const searchVectorUpdate = `UPDATE file_infos SET search_vector =
+	setweight(to_tsvector('` + searchConfig + `', COALESCE((
+		SELECT string_agg(tags.name, ' ') FROM file_tags
+		JOIN tags ON tags.id = file_tags.tag_id
+		WHERE file_tags.file_info_id = file_infos.id), '')), 'A') ||
+	setweight(to_tsvector('` + searchConfig + `', COALESCE(message_text, '')), 'B') ||
+	setweight(to_tsvector('` + searchConfig + `', regexp_replace(COALESCE(file_name, ''), '[._-]+', ' ', 'g')), 'C') ||
+	setweight(to_tsvector('` + searchConfig + `', COALESCE(sender_name, '')), 'D')`
+
+// Indexes again the given files, after they are saved or retagged
+func refreshSearchVector(db *gorm.DB, fileIDs []int) error {
+	if len(fileIDs) == 0 {
+		return nil
+	}
+	return db.Exec(searchVectorUpdate+` WHERE id IN ?`, fileIDs).Error
+}
+
+// Every word of the query has to match, the last ones as prefixes too
+// so results show up while typing. Empty when there are no words.
+func searchQuery(q string) string {
+	var terms []string
+	for _, word := range tagWordPattern.FindAllString(strings.ToLower(q), -1) {
+		terms = append(terms, word+":*")
+	}
+	return strings.Join(terms, " & ")
+}
+
+// Text the snippet is cut from, HTML escaped as the web app shows the
+// snippet as markup: only the highlighting tags are left unescaped
+const snippetText = `replace(replace(replace(replace(replace(
+	COALESCE(NULLIF(message_text, ''), file_name),
+	'&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&quot;'), '''', '&#39;')`
+
+// Visible files matching the query, best ranked first, with the
+// matched words highlighted in the snippet
+func searchArchive(db *gorm.DB, q string, limit int) ([]*searchResult, error) {
+	query := searchQuery(q)
+	if query == "" {
+		return []*searchResult{}, nil
+	}
+
+	var matches []struct {
+		ID      int
+		Rank    float64
+		Snippet string
+	}
+	tx := db.Raw(`SELECT id, ts_rank(search_vector, query) AS rank,
+			ts_headline('`+searchConfig+`', `+snippetText+`, query,
+				'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=20, MinWords=5') AS snippet
+		FROM file_infos, to_tsquery('`+searchConfig+`', ?) query
+		WHERE search_vector @@ query AND hidden = ?
+		ORDER BY rank DESC, id DESC
+		LIMIT ?`, query, false, limit).
+		Scan(&matches)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if len(matches) == 0 {
+		return []*searchResult{}, nil
+	}
+
+	ids := make([]int, len(matches))
+	for i, match := range matches {
+		ids[i] = match.ID
+	}
+	var files []*FileInfo
+	tx = db.Preload("Tags").Where("id IN ?", ids).Find(&files)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	byID := make(map[int]*FileInfo, len(files))
+	for _, file := range files {
+		byID[file.ID] = file
+	}
+
+	results := make([]*searchResult, 0, len(matches))
+	for _, match := range matches {
+		if file, ok := byID[match.ID]; ok {
+			results = append(results, &searchResult{File: file, Rank: match.Rank, Snippet: match.Snippet})
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSearchSnippetEscaped(t *testing.T) {
+	db := testDB(t)
+	files := []*FileInfo{
+		{FileName: "a.png", Digest: "a", MessageText: `funny cat <img src=x onerror="alert(1)"> & 'more'`},
+		// No text, the snippet comes from the name
+		{FileName: "<b>cat</b> meme.png", Digest: "b"},
+	}
+	for _, file := range files {
+		if err := db.Omit("Content").Create(file).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := refreshSearchVector(db, []int{file.ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := searchArchive(db, "cat", searchDefaultLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	for _, result := range results {
+		snippet := strings.NewReplacer("<mark>", "", "</mark>", "").Replace(result.Snippet)
+		if strings.ContainsAny(snippet, `<>"'`) {
+			t.Errorf("unescaped markup in snippet %q", result.Snippet)
+		}
+		if !strings.Contains(result.Snippet, "<mark>cat</mark>") {
+			t.Errorf("match not highlighted in snippet %q", result.Snippet)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+const (
+	// Approved memes are posted in the order they were approved
+	showcaseQueue = "queue"
+	// The best scored meme sent in the last 24 hours
+	showcaseDaily = "daily"
+)
+
+// How often the schedules of the guilds are checked
+const showcaseTick = time.Minute
+
+// Posts approved memes to the showcase channel of every guild at each
+// tick of its schedule, until the context is done. Schedules are checked
+// every minute so configuration changes apply without a restart.
+func (bot *memeBot) runShowcase(ctx context.Context) {
+	ticker := time.NewTicker(showcaseTick)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		now := time.Now()
+		for _, guild := range bot.guilds.list() {
+			if guild.ShowcaseChannel == "" || guild.schedule == nil {
+				continue
+			}
+			next := guild.schedule.Next(last)
+			if next.IsZero() || next.After(now) {
+				continue
+			}
+			bot.showcase(guild, now)
+		}
+		last = now
+	}
+}
+
+func (bot *memeBot) showcase(guild *GuildConfig, now time.Time) {
+	file, err := nextShowcaseFile(bot.gorm, guild.GuildID, guild.ShowcaseMode, now)
+	if err != nil {
+		log.Printf("Error picking meme to showcase on guild %s\n", guild.GuildID)
+		return
+	}
+	if file == nil {
+		log.Printf("Nothing to showcase on guild %s\n", guild.GuildID)
+		return
+	}
+	err = bot.publishFile(guild, file)
+	if err != nil {
+		log.Printf("Error showcasing file ID %d: %v\n", file.ID, err)
+	}
+}
+
+// Approved memes of the guild never posted before, picked according
+// to the mode
+func nextShowcaseFile(db *gorm.DB, guildID string, mode string, now time.Time) (*FileInfo, error) {
+	query := db.Where("guild_id = ? AND approved = ? AND hidden = ? AND published_at IS NULL AND path <> ''", guildID, true, false)
+	switch mode {
+	case showcaseDaily:
+		query = query.Where("sent >= ?", now.Add(-24*time.Hour)).Order("score DESC, sent")
+	default:
+		query = query.Order("time_reviewed, id")
+	}
+
+	var file FileInfo
+	tx := query.Limit(1).Find(&file)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if tx.RowsAffected < 1 {
+		return nil, nil
+	}
+	return &file, nil
+}
+
+func (bot *memeBot) publishFile(guild *GuildConfig, file *FileInfo) error {
+	content, err := bot.readFile(file.Path)
+	if err != nil {
+		return err
+	}
+
+	caption := fmt.Sprintf("Meme #%d", file.ID)
+	if guild.ShowcaseMode == showcaseDaily {
+		caption = fmt.Sprintf("Meme of the day #%d, score %d", file.ID, file.Score)
+	}
+	if link := sourceLink(file); link != "" {
+		caption += "\n" + link
+	}
+
+	message, err := bot.platform.SendMessage(guild.ShowcaseChannel, &discordgo.MessageSend{
+		Content: caption,
+		Files: []*discordgo.File{{
+			Name:        "meme" + path.Ext(file.Path),
+			ContentType: file.MimeType,
+			Reader:      bytes.NewReader(content),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	tx := bot.gorm.Model(&FileInfo{}).
+		Where("id = ?", file.ID).
+		Updates(FileInfo{PublishedMessageID: message.ID, PublishedAt: &now})
+	if tx.Error != nil {
+		return tx.Error
+	}
+	log.Printf("Showcased file ID %d in message ID: %s\n", file.ID, message.ID)
+	return nil
+}
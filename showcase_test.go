@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Approved before guilds were stored, the file has no guild and still
+// gets showcased on the default one
+func TestShowcaseFileWithoutGuild(t *testing.T) {
+	bot, fake := newTestBot(t)
+	content := testPNG(1)
+	reviewed := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	file := testFile("4001", "old.png", content)
+	file.GuildID = ""
+	file.Path = blobPath(file.Digest, file.FileName)
+	file.Reviewed, file.Approved, file.TimeReviewed = true, true, &reviewed
+	if err := bot.storage.Put(file.Path, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bot.gorm.Omit("Content").Create(file).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// As on the next start
+	if err := migrateTables(bot.gorm, testGuild); err != nil {
+		t.Fatal(err)
+	}
+	guild := bot.guilds.forGuild(testGuild)
+	showcase := *guild
+	showcase.ShowcaseChannel = "200"
+	bot.showcase(&showcase, time.Now())
+
+	if len(fake.Sent) != 1 || fake.Sent[0].ChannelID != "200" || len(fake.Sent[0].Attachments) != 1 {
+		t.Fatalf("file not showcased: %+v", fake.Sent)
+	}
+	var saved FileInfo
+	if err := bot.gorm.First(&saved, file.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if saved.GuildID != testGuild || saved.PublishedAt == nil || saved.PublishedMessageID != fake.Sent[0].ID {
+		t.Errorf("unexpected file after showcase: guild %q, published %v in %q", saved.GuildID, saved.PublishedAt, saved.PublishedMessageID)
+	}
+
+	// Posted once
+	bot.showcase(&showcase, time.Now())
+	if len(fake.Sent) != 1 {
+		t.Errorf("showcased %d times", len(fake.Sent))
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+)
+
+// Platforms the archived files come from
+const (
+	platformDiscord  = "discord"
+	platformTelegram = "telegram"
+)
+
+// A chat other than the Discord guilds memes are collected from. Each
+// source turns its messages into download jobs, so the same pipeline
+// checks, downloads, dedupes and stores them.
+type ingestSource interface {
+	// Stored on the files as their platform
+	Platform() string
+	// Feeds the jobs of new messages until the context is done
+	Run(ctx context.Context, ingest func(jobs []*PendingDownload))
+	// URL to download a job from, for sources whose links expire or
+	// carry credentials and can't be stored in the queue
+	ResolveURL(ctx context.Context, job *PendingDownload) (string, error)
+}
+
+// Sources enabled by the environment, none when only Discord is used
+func newIngestSources(policy *mediaPolicy) []ingestSource {
+	var sources []ingestSource
+	if token := os.Getenv("TELEGRAM_TOKEN"); token != "" {
+		chats := strings.FieldsFunc(os.Getenv("TELEGRAM_CHATS"), func(r rune) bool {
+			return r == ':' || r == ',' || r == ' '
+		})
+		sources = append(sources, newTelegramSource(os.Getenv("TELEGRAM_API_URL"), token, chats, policy))
+	}
+	return sources
+}
+
+// Queues the jobs not already archived, whatever the platform
+func (bot *memeBot) ingest(jobs []*PendingDownload, live bool) {
+	for _, job := range jobs {
+		if job.Platform == "" {
+			job.Platform = platformDiscord
+		}
+		if alreadyArchived(bot.gorm, job) {
+			continue
+		}
+		job.Live = live
+		bot.downloads.Enqueue(job)
+	}
+}
+
+// Discord links are stored as they are, other sources may need to
+// resolve theirs right before downloading
+func (bot *memeBot) resolveURL(ctx context.Context, job *PendingDownload) (string, error) {
+	for _, source := range bot.sources {
+		if source.Platform() == job.Platform {
+			return source.ResolveURL(ctx, job)
+		}
+	}
+	return job.URL, nil
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returned (wrapped) by every backend when the object is missing,
+// check it with errors.Is
+var ErrNotExist = fs.ErrNotExist
+
+// Common interface of the places where saved attachments are kept.
+// Names are slash separated paths relative to the storage root.
+type Storage interface {
+	Put(name string, content io.Reader) error
+	Get(name string) (io.ReadCloser, error)
+	Delete(name string) error
+	Stat(name string) (*ObjectInfo, error)
+	List(prefix string) ([]*ObjectInfo, error)
+}
+
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+type Config struct {
+	// "local" (default) or "s3"
+	Backend string
+	// Folder used by the local backend
+	Root string
+	S3   S3Config
+}
+
+// Returns the backend selected in the configuration
+func New(conf Config) (Storage, error) {
+	switch conf.Backend {
+	case "", "local":
+		return NewLocal(conf.Root)
+	case "s3":
+		return NewS3(conf.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", conf.Backend)
+	}
+}
+
+// Rejects names escaping the storage root
+func validName(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return fmt.Errorf("invalid object name %q", name)
+	}
+	return nil
+}
+
+// Serves the objects of a storage as static files, the request path
+// is the object name so mount it with http.StripPrefix
+func Handler(s Storage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ServeObject(w, r, s, strings.TrimPrefix(r.URL.Path, "/"))
+	})
+}
+
+// Writes a single object to the response, honouring Range and
+// conditional headers when the backend allows seeking
+func ServeObject(w http.ResponseWriter, r *http.Request, s Storage, name string) {
+	info, err := s.Stat(name)
+	if errors.Is(err, ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	content, err := s.Get(name)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	if seeker, ok := content.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, info.ModTime, seeker)
+		return
+	}
+
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, content)
+}
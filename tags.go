@@ -0,0 +1,206 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// Longer names are cut
+	maxTagLength = 32
+	// Suggestions kept for a single file
+	maxSuggestedTags = 10
+)
+
+// A label shared by any number of files, names are normalized by
+// normalizeTag so "Cats" and "cats" are the same tag
+type Tag struct {
+	ID        int       `gorm:"primaryKey" json:"id"`
+	Name      string    `gorm:"uniqueIndex" json:"name"`
+	CreatedAt time.Time `json:"-"`
+}
+
+type tagCount struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+var (
+	hashtagPattern  = regexp.MustCompile(`#([\p{L}\p{N}_-]+)`)
+	tagWordPattern  = regexp.MustCompile(`[\p{L}\p{N}]+`)
+	tagCharsPattern = regexp.MustCompile(`[^\p{L}\p{N}_-]+`)
+)
+
+// Words that say nothing about the content of a meme
+var tagStopwords = map[string]bool{
+	"meme": true, "memes": true, "general": true, "chat": true, "image": true,
+	"img": true, "video": true, "unknown": true, "screenshot": true, "photo": true,
+	"file": true, "media": true, "the": true, "and": true, "with": true,
+}
+
+// Lower case, spaces turned into dashes and anything else dropped,
+// empty when nothing is left
+func normalizeTag(name string) string {
+	name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(name), "#")))
+	name = strings.Join(strings.Fields(name), "-")
+	name = tagCharsPattern.ReplaceAllString(name, "")
+	name = strings.Trim(name, "-_")
+	if runes := []rune(name); len(runes) > maxTagLength {
+		name = string(runes[:maxTagLength])
+	}
+	return name
+}
+
+// Tags proposed for the files of a message: its hashtags first, then
+// the words of the channel name and of the file name. Numbers and
+// random looking names (eg: "IMG_2041", hashes) are skipped.
+func suggestTags(text string, channelName string, fileName string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	add := func(candidate string) {
+		tag := normalizeTag(candidate)
+		if len([]rune(tag)) < 3 || seen[tag] || tagStopwords[tag] || !looksLikeWord(tag) {
+			return
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+
+	for _, match := range hashtagPattern.FindAllStringSubmatch(text, -1) {
+		add(match[1])
+	}
+	for _, word := range tagWordPattern.FindAllString(channelName, -1) {
+		add(word)
+	}
+	name := strings.TrimSuffix(fileName, path.Ext(fileName))
+	for _, word := range tagWordPattern.FindAllString(name, -1) {
+		add(word)
+	}
+
+	if len(tags) > maxSuggestedTags {
+		tags = tags[:maxSuggestedTags]
+	}
+	return tags
+}
+
+// At least a letter and no more digits than letters
+func looksLikeWord(tag string) bool {
+	letters, digits := 0, 0
+	for _, r := range tag {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+		case r != '-' && r != '_':
+			letters++
+		}
+	}
+	return letters > 0 && digits <= letters/2
+}
+
+// Normalized, non empty and without duplicates
+func normalizeTags(names []string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		tag := normalizeTag(name)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// Tags with the given names, created when missing
+func findOrCreateTags(db *gorm.DB, names []string) ([]Tag, error) {
+	names = normalizeTags(names)
+	if len(names) == 0 {
+		return nil, nil
+	}
+	tags := make([]Tag, len(names))
+	for i, name := range names {
+		tags[i] = Tag{Name: name}
+	}
+	err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&tags).Error
+	if err != nil {
+		return nil, err
+	}
+	tags = nil
+	err = db.Where("name IN ?", names).Find(&tags).Error
+	return tags, err
+}
+
+func addTags(db *gorm.DB, fileIDs []int, names []string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		tags, err := findOrCreateTags(tx, names)
+		if err != nil || len(tags) == 0 {
+			return err
+		}
+		for _, id := range fileIDs {
+			err := tx.Model(&FileInfo{ID: id}).Association("Tags").Append(tags)
+			if err != nil {
+				return err
+			}
+		}
+		return refreshSearchVector(tx, fileIDs)
+	})
+}
+
+func removeTags(db *gorm.DB, fileIDs []int, names []string) error {
+	names = normalizeTags(names)
+	if len(names) == 0 || len(fileIDs) == 0 {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(
+			"DELETE FROM file_tags WHERE file_info_id IN ? AND tag_id IN (SELECT id FROM tags WHERE name IN ?)",
+			fileIDs, names,
+		).Error
+		if err != nil {
+			return err
+		}
+		return refreshSearchVector(tx, fileIDs)
+	})
+}
+
+func fileTags(db *gorm.DB, fileID int) ([]Tag, error) {
+	var tags []Tag
+	err := db.Model(&FileInfo{ID: fileID}).Order("name").Association("Tags").Find(&tags)
+	return tags, err
+}
+
+// Every tag in use with the number of visible files carrying it
+func tagCounts(db *gorm.DB) ([]tagCount, error) {
+	var counts []tagCount
+	tx := db.Table("tags").
+		Select("tags.name AS name, COUNT(*) AS count").
+		Joins("JOIN file_tags ON file_tags.tag_id = tags.id").
+		Joins("JOIN file_infos ON file_infos.id = file_tags.file_info_id").
+		Where("file_infos.hidden = ?", false).
+		Group("tags.name").
+		Order("count DESC, name").
+		Scan(&counts)
+	return counts, tx.Error
+}
+
+// Restricts the query to the files carrying all the tags
+func withTags(query *gorm.DB, names []string) *gorm.DB {
+	names = normalizeTags(names)
+	if len(names) == 0 {
+		return query
+	}
+	return query.Where(
+		`id IN (SELECT file_tags.file_info_id FROM file_tags
+			JOIN tags ON tags.id = file_tags.tag_id
+			WHERE tags.name IN ?
+			GROUP BY file_tags.file_info_id
+			HAVING COUNT(*) = ?)`,
+		names, len(names),
+	)
+}
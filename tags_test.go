@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTag(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "cats", want: "cats"},
+		{name: "  #Funny Cats ", want: "funny-cats"},
+		{name: "# spaced  out\ttag", want: "spaced-out-tag"},
+		{name: "C++ memes!", want: "c-memes"},
+		{name: "__dog_life__", want: "dog_life"},
+		{name: "-dash-", want: "dash"},
+		{name: "Ça Va", want: "ça-va"},
+		{name: "日本", want: "日本"},
+		{name: "💯", want: ""},
+		{name: "  ", want: ""},
+		{name: strings.Repeat("a", 40), want: strings.Repeat("a", maxTagLength)},
+		// Cut on characters, not bytes
+		{name: strings.Repeat("é", 40), want: strings.Repeat("é", maxTagLength)},
+	}
+	for _, test := range tests {
+		if got := normalizeTag(test.name); got != test.want {
+			t.Errorf("normalizeTag(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	got := normalizeTags([]string{"Cats", "#cats", "", "💯", "dogs"})
+	if want := []string{"cats", "dogs"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSuggestTags(t *testing.T) {
+	var many []string
+	for i := 0; i < maxSuggestedTags+2; i++ {
+		many = append(many, fmt.Sprintf("#tag%c", 'a'+i))
+	}
+	tests := []struct {
+		name     string
+		text     string
+		channel  string
+		fileName string
+		want     []string
+	}{
+		{name: "nothing", want: nil},
+		{name: "hashtags first", text: "lol #Cats #cats and #dog_life", channel: "cat-memes", fileName: "IMG_2041.png", want: []string{"cats", "dog_life", "cat"}},
+		{name: "file name words", channel: "general", fileName: "funny_dog_2023.gif", want: []string{"funny", "dog"}},
+		{name: "seen in the channel", channel: "dog-memes", fileName: "dog.jpg", want: []string{"dog"}},
+		{name: "hashes and numbers", fileName: "a3f9c2b7e1d4.jpg", want: nil},
+		{name: "short words", text: "#ab #x", channel: "ok", fileName: "x.png", want: nil},
+		{name: "stopwords", text: "#meme", channel: "chat-ANIME", fileName: "screenshot.png", want: []string{"anime"}},
+		{name: "few digits", fileName: "doge2.png", want: []string{"doge2"}},
+		{name: "capped", text: strings.Join(many, " "), channel: "anime", want: normalizeTags(many[:maxSuggestedTags])},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := suggestTags(test.text, test.channel, test.fileName)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWithTags(t *testing.T) {
+	db := testDB(t)
+	files := createPending(t, db, 4)
+	tagged := map[int][]string{0: {"cat", "funny"}, 1: {"cat"}, 2: {"Funny", "dog"}}
+	for i, names := range tagged {
+		if err := addTags(db, []int{files[i].ID}, names); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Hidden files keep their tags
+	db.Model(&FileInfo{}).Where("id = ?", files[1].ID).Update("hidden", true)
+
+	tests := []struct {
+		tags []string
+		want []int
+	}{
+		{tags: nil, want: []int{0, 1, 2, 3}},
+		{tags: []string{"cat"}, want: []int{0, 1}},
+		{tags: []string{"#Cat", "FUNNY"}, want: []int{0}},
+		{tags: []string{"cat", "cat"}, want: []int{0, 1}},
+		{tags: []string{"funny", "dog", "cat"}, want: nil},
+		{tags: []string{"unknown"}, want: nil},
+		{tags: []string{"💯"}, want: []int{0, 1, 2, 3}},
+	}
+	for _, test := range tests {
+		var ids []int
+		err := withTags(db.Model(&FileInfo{}), test.tags).Order("id").Pluck("id", &ids).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []int
+		for _, i := range test.want {
+			want = append(want, files[i].ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(want) {
+			t.Errorf("tags %v: got files %v, want %v", test.tags, ids, want)
+		}
+	}
+
+	counts, err := tagCounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []tagCount{{Name: "funny", Count: 2}, {Name: "cat", Count: 1}, {Name: "dog", Count: 1}}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("got counts %v, want %v", counts, want)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	telegramAPI = "https://api.telegram.org"
+	// Seconds getUpdates waits for new messages before returning
+	telegramPollTimeout = 30
+	// Pause after a failed request
+	telegramRetryDelay = 5 * time.Second
+)
+
+// Collects the media posted in the Telegram chats the bot is member
+// of, through the Bot API long polling
+type telegramSource struct {
+	baseURL string
+	token   string
+	// Chat IDs to archive, every chat when empty
+	chats  []string
+	policy *mediaPolicy
+	client *http.Client
+	offset int64
+}
+
+func newTelegramSource(baseURL string, token string, chats []string, policy *mediaPolicy) *telegramSource {
+	return &telegramSource{
+		baseURL: strings.TrimSuffix(orDefault(baseURL, telegramAPI), "/"),
+		token:   token,
+		chats:   chats,
+		policy:  policy,
+		client:  &http.Client{Timeout: (telegramPollTimeout + 10) * time.Second},
+	}
+}
+
+type telegramResponse struct {
+	OK          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	Description string          `json:"description"`
+}
+
+type telegramUpdate struct {
+	UpdateID    int64            `json:"update_id"`
+	Message     *telegramMessage `json:"message"`
+	ChannelPost *telegramMessage `json:"channel_post"`
+}
+
+type telegramMessage struct {
+	MessageID int64 `json:"message_id"`
+	Date      int64 `json:"date"`
+	Chat      struct {
+		ID       int64  `json:"id"`
+		Title    string `json:"title"`
+		Username string `json:"username"`
+	} `json:"chat"`
+	From *struct {
+		ID        int64  `json:"id"`
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Username  string `json:"username"`
+	} `json:"from"`
+	Caption   string         `json:"caption"`
+	Photo     []telegramFile `json:"photo"`
+	Document  *telegramFile  `json:"document"`
+	Video     *telegramFile  `json:"video"`
+	Animation *telegramFile  `json:"animation"`
+}
+
+// Photos, documents, videos and animations share these fields
+type telegramFile struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	FileName     string `json:"file_name"`
+	MimeType     string `json:"mime_type"`
+	FileSize     int64  `json:"file_size"`
+	FilePath     string `json:"file_path"`
+}
+
+func (t *telegramSource) Platform() string {
+	return platformTelegram
+}
+
+func (t *telegramSource) call(ctx context.Context, method string, params url.Values, result interface{}) error {
+	endpoint := fmt.Sprintf("%s/bot%s/%s", t.baseURL, t.token, method)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := t.client.Do(req)
+	if err != nil {
+		// The token is part of the URL, don't leak it in the logs
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return fmt.Errorf("telegram %s: %w", method, urlErr.Err)
+		}
+		return err
+	}
+	defer res.Body.Close()
+
+	var response telegramResponse
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return fmt.Errorf("telegram %s: %s", method, res.Status)
+	}
+	if !response.OK {
+		return fmt.Errorf("telegram %s: %s", method, response.Description)
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+func (t *telegramSource) Run(ctx context.Context, ingest func(jobs []*PendingDownload)) {
+	log.Println("Telegram ingestion started")
+	for ctx.Err() == nil {
+		var updates []telegramUpdate
+		err := t.call(ctx, "getUpdates", url.Values{
+			"offset":          {strconv.FormatInt(t.offset, 10)},
+			"timeout":         {strconv.Itoa(telegramPollTimeout)},
+			"allowed_updates": {`["message","channel_post"]`},
+		}, &updates)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Error getting Telegram updates: %v\n", err)
+			select {
+			case <-time.After(telegramRetryDelay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		for _, update := range updates {
+			// Confirms the update on the next request
+			t.offset = update.UpdateID + 1
+			message := update.Message
+			if message == nil {
+				message = update.ChannelPost
+			}
+			if message == nil {
+				continue
+			}
+			if jobs := t.messageJobs(message); len(jobs) > 0 {
+				ingest(jobs)
+			}
+		}
+	}
+}
+
+// Download jobs for the media of a message, the job URL holds the
+// file ID as download links are only valid for an hour
+func (t *telegramSource) messageJobs(message *telegramMessage) []*PendingDownload {
+	chatID := strconv.FormatInt(message.Chat.ID, 10)
+	if len(t.chats) > 0 && !slices.Contains(t.chats, chatID) && !slices.Contains(t.chats, "@"+message.Chat.Username) {
+		return nil
+	}
+
+	var files []*telegramFile
+	// Sizes of the same photo, the last one is the largest
+	if len(message.Photo) > 0 {
+		photo := message.Photo[len(message.Photo)-1]
+		photo.MimeType = "image/jpeg"
+		files = append(files, &photo)
+	}
+	for _, file := range []*telegramFile{message.Document, message.Video, message.Animation} {
+		if file != nil {
+			files = append(files, file)
+		}
+	}
+
+	// Channel posts are sent by the channel itself
+	sender, senderName := chatID, message.Chat.Title
+	if message.From != nil {
+		sender = strconv.FormatInt(message.From.ID, 10)
+		senderName = strings.TrimSpace(message.From.FirstName + " " + message.From.LastName)
+		senderName = orDefault(senderName, message.From.Username)
+	}
+	var jobs []*PendingDownload
+	for _, file := range files {
+		name := orDefault(file.FileName, file.FileUniqueID+telegramExt(file.MimeType))
+		err := t.policy.precheck(file.FileSize, file.MimeType)
+		if err != nil {
+			log.Printf("Rejected %s of Telegram message %s/%d: %v\n", name, chatID, message.MessageID, err)
+			continue
+		}
+		jobs = append(jobs, &PendingDownload{
+			Platform:     platformTelegram,
+			URL:          file.FileID,
+			FileName:     name,
+			DeclaredType: file.MimeType,
+			Sender:       sender,
+			ChannelID:    chatID,
+			MessageID:    strconv.FormatInt(message.MessageID, 10),
+			Sent:         time.Unix(message.Date, 0),
+
+			SuggestedTags: suggestTags(message.Caption, message.Chat.Title, name),
+			MessageText:   message.Caption,
+			SenderName:    senderName,
+		})
+	}
+	return jobs
+}
+
+func (t *telegramSource) ResolveURL(ctx context.Context, job *PendingDownload) (string, error) {
+	var file telegramFile
+	err := t.call(ctx, "getFile", url.Values{"file_id": {job.URL}}, &file)
+	if err != nil {
+		return "", err
+	}
+	if file.FilePath == "" {
+		return "", fmt.Errorf("telegram file %s not available", job.FileName)
+	}
+	return fmt.Sprintf("%s/file/bot%s/%s", t.baseURL, t.token, file.FilePath), nil
+}
+
+// Photos and animations are sent without a name
+func telegramExt(mimeType string) string {
+	switch mimeType {
+	case "image/jpeg":
+		return ".jpg"
+	case "video/mp4":
+		return ".mp4"
+	}
+	if ext := path.Base(mimeType); mimeType != "" && ext != "." {
+		return "." + ext
+	}
+	return ""
+}
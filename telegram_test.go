@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTelegramToken = "123456:SECRET-token"
+
+// Stand-in for the Bot API: a single batch of updates, then the
+// getFile of any file ID is answered with the files map
+type fakeTelegram struct {
+	t       *testing.T
+	mu      sync.Mutex
+	updates []map[string]interface{}
+	files   map[string]string
+	offsets []string
+	// Called once the updates have been confirmed
+	done func()
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if strings.HasPrefix(r.URL.Path, "/file/") {
+		// Dropped mid request
+		if strings.Contains(r.URL.Path, "/hangup/") {
+			if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+				conn.Close()
+			}
+			return
+		}
+		w.Write([]byte("GIF89a"))
+		return
+	}
+	method := strings.TrimPrefix(r.URL.Path, "/bot"+testTelegramToken+"/")
+	if method == r.URL.Path {
+		f.t.Errorf("request without the token: %s", r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	r.ParseForm()
+
+	var result interface{}
+	switch method {
+	case "getUpdates":
+		f.offsets = append(f.offsets, r.PostForm.Get("offset"))
+		result = []interface{}{}
+		if len(f.offsets) == 1 {
+			result = f.updates
+		} else if f.done != nil {
+			f.done()
+		}
+	case "getFile":
+		filePath, ok := f.files[r.PostForm.Get("file_id")]
+		if !ok {
+			json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "description": "Bad Request: invalid file_id"})
+			return
+		}
+		result = map[string]interface{}{"file_id": r.PostForm.Get("file_id"), "file_path": filePath}
+	case "getMe":
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("<html>bad gateway</html>"))
+		return
+	default:
+		f.t.Errorf("unexpected method %s", method)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": result})
+}
+
+func newTestTelegram(t *testing.T, chats []string) (*telegramSource, *fakeTelegram, *httptest.Server) {
+	fake := &fakeTelegram{t: t, files: make(map[string]string)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	policy := defaultMediaPolicy
+	policy.maxBytes = 1 << 20
+	return newTelegramSource(server.URL+"/", testTelegramToken, chats, &policy), fake, server
+}
+
+func testUpdate(id int64, kind string, message map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"update_id": id, kind: message}
+}
+
+func TestTelegramRun(t *testing.T) {
+	source, fake, _ := newTestTelegram(t, []string{"-100", "@memes"})
+	photo := func(id string, size int64) map[string]interface{} {
+		return map[string]interface{}{"file_id": id, "file_unique_id": "u" + id, "file_size": size}
+	}
+	fake.updates = []map[string]interface{}{
+		testUpdate(41, "message", map[string]interface{}{
+			"message_id": 7, "date": 1677672000, "caption": "#caturday",
+			"chat": map[string]interface{}{"id": -100, "title": "Cat memes"},
+			"from": map[string]interface{}{"id": 55, "first_name": "Ann", "last_name": "Lee"},
+			// Sizes of the same photo, smallest first
+			"photo": []interface{}{photo("small", 1000), photo("medium", 5000), photo("large", 20000)},
+		}),
+		testUpdate(42, "channel_post", map[string]interface{}{
+			"message_id": 8, "date": 1677672000,
+			"chat":     map[string]interface{}{"id": -200, "title": "Memes", "username": "memes"},
+			"document": map[string]interface{}{"file_id": "doc", "file_unique_id": "udoc", "file_name": "dance.gif", "mime_type": "image/gif", "file_size": 300},
+		}),
+		// Not an archived chat
+		testUpdate(43, "message", map[string]interface{}{
+			"message_id": 9, "date": 1677672000,
+			"chat":  map[string]interface{}{"id": -300, "title": "Elsewhere"},
+			"photo": []interface{}{photo("other", 1000)},
+		}),
+		// Rejected before downloading: too large, and not a media type
+		testUpdate(44, "message", map[string]interface{}{
+			"message_id": 10, "date": 1677672000,
+			"chat":     map[string]interface{}{"id": -100, "title": "Cat memes"},
+			"video":    map[string]interface{}{"file_id": "big", "file_unique_id": "ubig", "mime_type": "video/mp4", "file_size": 2 << 20},
+			"document": map[string]interface{}{"file_id": "pdf", "file_unique_id": "updf", "file_name": "notes.pdf", "mime_type": "application/pdf", "file_size": 300},
+		}),
+		testUpdate(45, "edited_message", map[string]interface{}{}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	fake.done = cancel
+	var jobs []*PendingDownload
+	source.Run(ctx, func(batch []*PendingDownload) {
+		jobs = append(jobs, batch...)
+	})
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.offsets) < 2 || fake.offsets[0] != "0" || fake.offsets[1] != "46" {
+		t.Errorf("got offsets %v, want the updates confirmed with 46", fake.offsets)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("got %d jobs, want 2", len(jobs))
+	}
+
+	photoJob := jobs[0]
+	if photoJob.URL != "large" || photoJob.FileName != "ularge.jpg" || photoJob.DeclaredType != "image/jpeg" {
+		t.Errorf("not the largest photo size: %+v", photoJob)
+	}
+	if photoJob.Platform != platformTelegram || photoJob.ChannelID != "-100" || photoJob.MessageID != "7" {
+		t.Errorf("unexpected source %s %s/%s", photoJob.Platform, photoJob.ChannelID, photoJob.MessageID)
+	}
+	if photoJob.Sender != "55" || photoJob.SenderName != "Ann Lee" || photoJob.MessageText != "#caturday" {
+		t.Errorf("unexpected sender %s %q, text %q", photoJob.Sender, photoJob.SenderName, photoJob.MessageText)
+	}
+	if !photoJob.Sent.Equal(time.Unix(1677672000, 0)) {
+		t.Errorf("unexpected date %v", photoJob.Sent)
+	}
+
+	// Channel posts come from the channel
+	postJob := jobs[1]
+	if postJob.URL != "doc" || postJob.FileName != "dance.gif" || postJob.Sender != "-200" || postJob.SenderName != "Memes" {
+		t.Errorf("unexpected channel post job %+v", postJob)
+	}
+}
+
+func TestTelegramResolveURL(t *testing.T) {
+	source, fake, server := newTestTelegram(t, nil)
+	fake.files["large"] = "photos/file_1.jpg"
+
+	link, err := source.ResolveURL(context.Background(), &PendingDownload{URL: "large", FileName: "ularge.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := server.URL + "/file/bot" + testTelegramToken + "/photos/file_1.jpg"; link != want {
+		t.Errorf("got %s, want %s", link, want)
+	}
+
+	fake.files["gone"] = ""
+	if _, err := source.ResolveURL(context.Background(), &PendingDownload{URL: "gone", FileName: "gone.jpg"}); err == nil {
+		t.Error("resolved a file without path")
+	}
+}
+
+// The token is in every URL of the Bot API, it must not end up in the
+// logs or in the download queue
+func TestTelegramErrorsHideToken(t *testing.T) {
+	source, fake, server := newTestTelegram(t, nil)
+	fake.files["hangup"] = "hangup/file.gif"
+	ctx := context.Background()
+
+	checkErr := func(name string, err error) {
+		t.Helper()
+		if err == nil {
+			t.Errorf("%s: no error", name)
+			return
+		}
+		if strings.Contains(err.Error(), "SECRET") {
+			t.Errorf("%s: token in error %q", name, err)
+		}
+	}
+
+	_, err := source.ResolveURL(ctx, &PendingDownload{URL: "missing", FileName: "missing.jpg"})
+	checkErr("API error", err)
+	checkErr("bad gateway", source.call(ctx, "getMe", nil, &struct{}{}))
+
+	// Downloads are resolved to a link with the token
+	d := newDownloader(ctx, defaultDownloaderConf, source.policy, nil, nil, source.ResolveURL)
+	_, _, err = d.fetch(&PendingDownload{Platform: platformTelegram, URL: "hangup", FileName: "file.gif"})
+	checkErr("download", err)
+
+	server.Close()
+	_, err = source.ResolveURL(ctx, &PendingDownload{URL: "hangup", FileName: "file.gif"})
+	checkErr("connection refused", err)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"path"
+)
+
+// Thumbnails fit in a square of this side, keeping the aspect ratio
+const thumbnailSize = 320
+
+type thumbnail struct {
+	content []byte
+	ext     string
+	// Size of the original picture
+	width  int
+	height int
+}
+
+// Decodes the picture (first frame for GIFs) and scales it down
+// with a box filter. Transparent pictures are kept as PNG, the rest
+// is encoded as JPEG.
+func makeThumbnail(content []byte) (*thumbnail, error) {
+	src, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	dstW, dstH := width, height
+	if width > thumbnailSize || height > thumbnailSize {
+		if width >= height {
+			dstW, dstH = thumbnailSize, max(height*thumbnailSize/width, 1)
+		} else {
+			dstW, dstH = max(width*thumbnailSize/height, 1), thumbnailSize
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	scaleDown(dst, src)
+
+	var buf bytes.Buffer
+	ext := ".jpg"
+	if isOpaque(src) {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80})
+	} else {
+		ext = ".png"
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &thumbnail{content: buf.Bytes(), ext: ext, width: width, height: height}, nil
+}
+
+// Every destination pixel is the average of the source pixels it covers
+func scaleDown(dst *image.RGBA, src image.Image) {
+	sb, db := src.Bounds(), dst.Bounds()
+	if sb.Dx() == db.Dx() && sb.Dy() == db.Dy() {
+		draw.Draw(dst, db, src, sb.Min, draw.Src)
+		return
+	}
+	for y := 0; y < db.Dy(); y++ {
+		y0 := sb.Min.Y + y*sb.Dy()/db.Dy()
+		y1 := max(sb.Min.Y+(y+1)*sb.Dy()/db.Dy(), y0+1)
+		for x := 0; x < db.Dx(); x++ {
+			x0 := sb.Min.X + x*sb.Dx()/db.Dx()
+			x1 := max(sb.Min.X+(x+1)*sb.Dx()/db.Dx(), x0+1)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n),
+			})
+		}
+	}
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// Thumbnails live next to the originals, under their own folder
+func thumbPath(digest string, ext string) string {
+	return path.Join("thumb", blobPath(digest, ext))
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func filled(width int, height int, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Close enough after a JPEG round trip
+func near(c color.Color, want color.RGBA) bool {
+	r, g, b, _ := c.RGBA()
+	diff := func(got uint32, want uint8) bool {
+		d := int(got>>8) - int(want)
+		return d > -16 && d < 16
+	}
+	return diff(r, want.R) && diff(g, want.G) && diff(b, want.B)
+}
+
+func TestMakeThumbnail(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	tests := []struct {
+		name          string
+		width, height int
+		wantW, wantH  int
+	}{
+		{name: "landscape", width: 640, height: 480, wantW: 320, wantH: 240},
+		{name: "portrait", width: 480, height: 640, wantW: 240, wantH: 320},
+		{name: "square", width: 1000, height: 1000, wantW: 320, wantH: 320},
+		{name: "small", width: 100, height: 50, wantW: 100, wantH: 50},
+		{name: "one side over", width: 321, height: 10, wantW: 320, wantH: 9},
+		{name: "thin", width: 2000, height: 2, wantW: 320, wantH: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			thumb, err := makeThumbnail(encodePNG(t, filled(test.width, test.height, red)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if thumb.width != test.width || thumb.height != test.height {
+				t.Errorf("got original size %dx%d", thumb.width, thumb.height)
+			}
+			// Opaque, so a JPEG
+			img, err := jpeg.Decode(bytes.NewReader(thumb.content))
+			if err != nil || thumb.ext != ".jpg" {
+				t.Fatalf("thumbnail %s not a JPEG: %v", thumb.ext, err)
+			}
+			if size := img.Bounds().Size(); size.X != test.wantW || size.Y != test.wantH {
+				t.Errorf("got %dx%d, want %dx%d", size.X, size.Y, test.wantW, test.wantH)
+			}
+			if !near(img.At(0, 0), red) {
+				t.Errorf("got color %v", img.At(0, 0))
+			}
+		})
+	}
+
+	t.Run("transparent", func(t *testing.T) {
+		img := filled(640, 640, color.NRGBA{0, 0, 255, 255})
+		for x := 0; x < 320; x++ {
+			img.Set(x, 0, color.NRGBA{})
+			img.Set(x, 1, color.NRGBA{})
+		}
+		thumb, err := makeThumbnail(encodePNG(t, img))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := png.Decode(bytes.NewReader(thumb.content))
+		if err != nil || thumb.ext != ".png" {
+			t.Fatalf("thumbnail %s not a PNG: %v", thumb.ext, err)
+		}
+		if _, _, _, a := decoded.At(0, 0).RGBA(); a != 0 {
+			t.Errorf("transparency lost, alpha %d", a)
+		}
+		if _, _, _, a := decoded.At(300, 300).RGBA(); a != 0xffff {
+			t.Errorf("opaque part with alpha %d", a)
+		}
+	})
+
+	t.Run("gif first frame", func(t *testing.T) {
+		palette := color.Palette{color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}}
+		animation := &gif.GIF{Delay: []int{10, 10}}
+		for i := range palette {
+			frame := image.NewPaletted(image.Rect(0, 0, 400, 200), palette)
+			for j := range frame.Pix {
+				frame.Pix[j] = uint8(i)
+			}
+			animation.Image = append(animation.Image, frame)
+		}
+		var buf bytes.Buffer
+		if err := gif.EncodeAll(&buf, animation); err != nil {
+			t.Fatal(err)
+		}
+		thumb, err := makeThumbnail(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := jpeg.Decode(bytes.NewReader(thumb.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Size(); size.X != 320 || size.Y != 160 {
+			t.Errorf("got %dx%d, want 320x160", size.X, size.Y)
+		}
+		if !near(img.At(100, 100), red) {
+			t.Errorf("got color %v, want the red first frame", img.At(100, 100))
+		}
+	})
+
+	if _, err := makeThumbnail([]byte("not a picture")); err == nil {
+		t.Error("thumbnail made of text")
+	}
+}
+
+func TestScaleDown(t *testing.T) {
+	// Four quadrants, each of its own color
+	quadrants := []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {255, 255, 255, 255}}
+	src := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			src.SetRGBA(x, y, quadrants[y/4*2+x/4])
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	scaleDown(dst, src)
+	for i, want := range quadrants {
+		if got := dst.RGBAAt(i%2, i/2); got != want {
+			t.Errorf("quadrant %d: got %v, want %v", i, got, want)
+		}
+	}
+
+	// The average of the pixels covered
+	dst = image.NewRGBA(image.Rect(0, 0, 1, 1))
+	scaleDown(dst, src)
+	if got, want := dst.RGBAAt(0, 0), (color.RGBA{127, 127, 127, 255}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Pictures not starting at the origin
+	sub := src.SubImage(image.Rect(4, 4, 8, 8))
+	dst = image.NewRGBA(image.Rect(0, 0, 2, 2))
+	scaleDown(dst, sub)
+	if got := dst.RGBAAt(1, 1); got != quadrants[3] {
+		t.Errorf("got %v from a sub image, want %v", got, quadrants[3])
+	}
+	dst = image.NewRGBA(image.Rect(0, 0, 4, 4))
+	scaleDown(dst, sub)
+	if got := dst.RGBAAt(0, 0); got != quadrants[3] {
+		t.Errorf("got %v copying a sub image, want %v", got, quadrants[3])
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Reactions fetched per request when reconciling votes
+const reactionsPageSize = 100
+
+// A member reaction counted as vote on the files of a message. Votes
+// are kept by message so they can be recorded before its files are
+// downloaded.
+type Vote struct {
+	ID        int    `gorm:"primaryKey" json:"id"`
+	MessageID string `gorm:"uniqueIndex:idx_vote" json:"message_id"`
+	UserID    string `gorm:"uniqueIndex:idx_vote" json:"user_id"`
+	Value     int    `gorm:"uniqueIndex:idx_vote" json:"value"`
+}
+
+// +1 or -1 for the vote emojis of the guild observing the channel,
+// 0 for anything else
+func (bot *memeBot) voteValue(channelID string, emoji discordgo.Emoji) int {
+	guild := bot.guilds.forChannel(channelID)
+	if guild == nil {
+		return 0
+	}
+	switch emoji.APIName() {
+	case guild.UpvoteEmoji:
+		return 1
+	case guild.DownvoteEmoji:
+		return -1
+	}
+	return 0
+}
+
+func (bot *memeBot) addVote(channelID string, messageID string, userID string, value int) {
+	vote := &Vote{MessageID: messageID, UserID: userID, Value: value}
+	tx := bot.gorm.Clauses(clause.OnConflict{DoNothing: true}).Create(vote)
+	if tx.Error != nil {
+		log.Println("Error saving vote")
+		return
+	}
+	bot.refreshScore(channelID, messageID)
+}
+
+func (bot *memeBot) removeVote(channelID string, messageID string, userID string, value int) {
+	tx := bot.gorm.Where(&Vote{MessageID: messageID, UserID: userID, Value: value}).Delete(&Vote{})
+	if tx.Error != nil {
+		log.Println("Error removing vote")
+		return
+	}
+	bot.refreshScore(channelID, messageID)
+}
+
+// Recounts the votes of a message on its files, approving the ones
+// crossing the score configured for the guild
+func (bot *memeBot) refreshScore(channelID string, messageID string) {
+	var tally struct {
+		Upvotes   int
+		Downvotes int
+	}
+	tx := bot.gorm.Model(&Vote{}).
+		Select(`COUNT(*) FILTER (WHERE value > 0) AS upvotes,
+			COUNT(*) FILTER (WHERE value < 0) AS downvotes`).
+		Where("message_id = ?", messageID).
+		Scan(&tally)
+	if tx.Error != nil {
+		log.Println("Error counting votes")
+		return
+	}
+	tx = bot.gorm.Model(&FileInfo{}).
+		Where("message_id = ?", messageID).
+		Updates(map[string]interface{}{
+			"upvotes":   tally.Upvotes,
+			"downvotes": tally.Downvotes,
+			"score":     tally.Upvotes - tally.Downvotes,
+		})
+	if tx.Error != nil {
+		log.Println("Error updating score")
+		return
+	}
+
+	guild := bot.guilds.forChannel(channelID)
+	if guild == nil {
+		return
+	}
+	threshold := guild.AutoApproveScore
+	if threshold <= 0 || tally.Upvotes-tally.Downvotes < threshold {
+		return
+	}
+	var pending []*FileInfo
+	// Files still waiting for other reviewers have the community vote already
+	tx = bot.gorm.
+		Where("message_id = ? AND reviewed = ?", messageID, false).
+		Where("id NOT IN (SELECT file_id FROM review_events WHERE source = ? AND decision = ? AND undone = ?)",
+			sourceVotes, decisionApprove, false).
+		Find(&pending)
+	if tx.Error != nil {
+		return
+	}
+	reason := fmt.Sprintf("score %d", tally.Upvotes-tally.Downvotes)
+	for _, file := range pending {
+		err := reviewFile(bot.gorm, bot.conf.review, file.ID, true, reviewer{source: sourceVotes}, reason)
+		if err != nil {
+			log.Printf("Error auto approving file ID %d\n", file.ID)
+			continue
+		}
+		log.Printf("Auto approved post %d with score %d\n", file.ID, tally.Upvotes-tally.Downvotes)
+		bot.syncReactions(file.ChannelID, file.MessageID)
+	}
+}
+
+// Rebuilds the votes of a message from its current reactions, for
+// the ones added or removed while the bot was offline
+func (bot *memeBot) reconcileVotes(message *discordgo.Message) {
+	votes := make(map[int][]string)
+	for _, reaction := range message.Reactions {
+		value := bot.voteValue(message.ChannelID, *reaction.Emoji)
+		if value == 0 || reaction.Count == 0 {
+			continue
+		}
+		users, err := bot.reactionUsers(message, reaction.Emoji.APIName())
+		if err != nil {
+			log.Printf("Error getting reactions of message ID %s\n", message.ID)
+			return
+		}
+		votes[value] = users
+	}
+
+	err := bot.gorm.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("message_id = ?", message.ID).Delete(&Vote{}).Error
+		if err != nil {
+			return err
+		}
+		for value, users := range votes {
+			for _, user := range users {
+				err := tx.Create(&Vote{MessageID: message.ID, UserID: user, Value: value}).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Error reconciling votes")
+		return
+	}
+	bot.refreshScore(message.ChannelID, message.ID)
+}
+
+// Every member who reacted with the emoji, the bot excluded
+func (bot *memeBot) reactionUsers(message *discordgo.Message, emoji string) ([]string, error) {
+	var ids []string
+	after := ""
+	for {
+		users, err := bot.platform.MessageReactions(message.ChannelID, message.ID, emoji, reactionsPageSize, after)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			if user.ID != bot.platform.UserID() {
+				ids = append(ids, user.ID)
+			}
+		}
+		if len(users) < reactionsPageSize {
+			return ids, nil
+		}
+		after = users[len(users)-1].ID
+	}
+}
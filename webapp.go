@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"memegrab/cattp"
 	"memegrab/sessions"
+	"memegrab/storage"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
@@ -29,6 +38,11 @@ type webapp struct {
 	sessions sessions.SessionManager
 	db       *sql.DB
 	gorm     *gorm.DB
+	storage  storage.Storage
+	guilds   *guildRegistry
+	review   reviewPolicy
+	// Lets the bot mirror the decision on Discord
+	onReview func(fileID int)
 }
 
 type Payload struct {
@@ -37,15 +51,21 @@ type Payload struct {
 }
 
 // For URL use only domain name eg: google.it not https://google.it
-func startWebApp(conf cattp.Config, db *sql.DB, gorm *gorm.DB, sessions sessions.SessionManager) error {
+func startWebApp(conf cattp.Config, db *sql.DB, gorm *gorm.DB, store storage.Storage, sessions sessions.SessionManager, guilds *guildRegistry, review reviewPolicy, onReview func(int)) error {
 	// httpAddr := fmt.Sprintf("%s:%s", conf.Host, conf.portPlain)
 	context := &webapp{
 		db:       db,
 		sessions: sessions,
 		gorm:     gorm,
+		storage:  store,
+		guilds:   guilds,
+		review:   review,
+		onReview: onReview,
 	}
 
 	router := cattp.New(context)
+	router.Mux.Handle("/img/", http.StripPrefix("/img/", storage.Handler(store)))
+	router.HandleFunc("/img/thumb/", thumbHandle)
 	// router.HandleFunc("/", rootHandler)
 	router.HandleFunc("/auth", validateHandle)
 	router.HandleFunc("/auth/validate", validateHandle)
@@ -53,9 +73,20 @@ func startWebApp(conf cattp.Config, db *sql.DB, gorm *gorm.DB, sessions sessions
 	router.HandleFunc("/auth/signout", signoutHandle)
 
 	router.HandleFunc("/mod/review", approveHandle)
+	router.HandleFunc("/mod/undo", undoHandle)
+	router.HandleFunc("/mod/bulk", bulkHandle)
+	router.HandleFunc("/mod/tags", retagHandle)
+	router.HandleFunc("/mod/queue", queueHandle)
+	router.HandleFunc("/mod/queue/release", releaseHandle)
+
+	router.HandleFunc("/guilds", guildsHandle)
+	router.HandleFunc("/guilds/", guildHandle)
 
 	router.HandleFunc("/profile", profileHandle)
 	router.HandleFunc("/saved", savedHandle)
+	router.HandleFunc("/saved/", savedFileHandle)
+	router.HandleFunc("/tags", tagsHandle)
+	router.HandleFunc("/search", searchHandle)
 	router.HandleFunc("/test", testHandler)
 
 	err := router.Listen(&conf)
@@ -233,8 +264,11 @@ var approveHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *ht
 	fileId := r.URL.Query().Get("id")
 	isApproved := r.URL.Query().Get("approved")
 
-	if (fileId == "") || (isApproved == "") {
+	id, err := strconv.Atoi(fileId)
+	if err != nil || isApproved == "" {
 		log.Println("Arguments not provided")
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 	approved := false
 	if isApproved == "true" {
@@ -242,14 +276,25 @@ var approveHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *ht
 	}
 	log.Printf("Approved: %v\n", approved)
 
-	time := time.Now()
-
-	tx := context.gorm.Model(&FileInfo{}).Where("id =?", fileId).Updates(FileInfo{Reviewed: true, TimeReviewed: &time, Approved: approved})
-
-	if tx.Error != nil {
-		// TODO: Extend session upon device validation
-		log.Println("Invalid session")
-		w.WriteHeader(http.StatusUnauthorized)
+	by, err := context.webReviewer(session.UserId)
+	if err != nil {
+		log.Println("Error reading profile")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	err = reviewFile(context.gorm, context.review, id, approved, by, reason)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errClaimed) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Println("Error reviewing file")
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
@@ -257,6 +302,190 @@ var approveHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *ht
 	// TODO: Post response for WebSock?
 	// w.Header().Add("Content-Type", "application/json")
 	log.Printf("[%d] Reviewed post %s\n", session.UserId, fileId)
+	if context.onReview != nil {
+		context.onReview(id)
+	}
+	w.WriteHeader(http.StatusOK)
+})
+
+// Takes back the last decision of the user on a file, within the
+// configured window
+var undoHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *http.Request, context *webapp) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	session, err := context.sessions.Validate(context.db, r)
+	if err != nil {
+		log.Println("Invalid session")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		log.Println("Arguments not provided")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	by := reviewer{userID: session.UserId, source: sourceWeb}
+	event, err := undoReview(context.gorm, context.review, id, by)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case errors.Is(err, errNotReviewer):
+		w.WriteHeader(http.StatusForbidden)
+		return
+	case errors.Is(err, errUndoExpired):
+		w.WriteHeader(http.StatusConflict)
+		return
+	case err != nil:
+		log.Println("Error undoing review")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[%d] Undid review of post %d\n", session.UserId, id)
+	if context.onReview != nil {
+		context.onReview(id)
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(payload)
+})
+
+// Reviews, tags or deletes many files at once, answering with the
+// outcome of each item
+var bulkHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *http.Request, context *webapp) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	session, err := context.sessions.Validate(context.db, r)
+	if err != nil {
+		log.Println("Invalid session")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var request bulkRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || len(request.Items) == 0 || len(request.Items) > bulkMaxItems {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	by, err := context.webReviewer(session.UserId)
+	if err != nil {
+		log.Println("Error reading profile")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	results, err := applyBulk(context.gorm, context.review, by, request.Items)
+	if err != nil {
+		log.Println("Error applying bulk moderation")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	payload, err := json.Marshal(map[string]interface{}{"results": results})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	applied := 0
+	for _, result := range results {
+		if result.Status != http.StatusOK {
+			continue
+		}
+		applied++
+		if context.onReview != nil && (result.Action == bulkApprove || result.Action == bulkReject) {
+			context.onReview(result.ID)
+		}
+	}
+	log.Printf("[%d] Applied %d of %d bulk items\n", session.UserId, applied, len(results))
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(payload)
+})
+
+// Hands out the next items to review, claimed for the user
+var queueHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *http.Request, context *webapp) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	session, err := context.sessions.Validate(context.db, r)
+	if err != nil {
+		log.Println("Invalid session")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	limit := queueDefaultLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > queueMaxLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	files, err := claimNext(context.gorm, session.UserId, limit, time.Now())
+	if err != nil {
+		log.Println("Error claiming files to review")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	payload, err := json.Marshal(files)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[%d] Claimed %d posts to review\n", session.UserId, len(files))
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(payload)
+})
+
+type releaseRequest struct {
+	IDs []int `json:"ids"`
+}
+
+// Gives back the claims of the user, the listed ones or all of them
+var releaseHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *http.Request, context *webapp) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	session, err := context.sessions.Validate(context.db, r)
+	if err != nil {
+		log.Println("Invalid session")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var request releaseRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	count, err := releaseClaims(context.gorm, session.UserId, request.IDs)
+	if err != nil {
+		log.Println("Error releasing claims")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[%d] Released %d claims\n", session.UserId, count)
 	w.WriteHeader(http.StatusOK)
 })
 
@@ -276,17 +505,468 @@ var savedHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *http
 		return
 	}
 
-	dbSaved := getDbMessages(context.gorm)
+	query, err := parseSavedQuery(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	dbSaved, next, err := listSaved(context.gorm, query)
+	if err != nil {
+		log.Println("Error getting saved files")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	saved, err := json.Marshal(dbSaved)
 	if err != nil {
 		panic(err)
 	}
 	log.Printf("[%d][ID %v] Get Saved Files\n", http.StatusOK, session.UserId)
 
+	// Same filters, from where this page ends
+	if next != nil {
+		values := r.URL.Query()
+		values.Set("cursor", next.encode())
+		nextURL := url.URL{Path: r.URL.Path, RawQuery: values.Encode()}
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, nextURL.String()))
+	}
 	w.Header().Add("Content-Type", "application/json")
 	w.Write(saved)
 })
 
+// Routes under a single saved file: /saved/{id}, /saved/{id}/tags,
+// /saved/{id}/history and /saved/{id}/download
+var savedFileHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *http.Request, context *webapp) {
+	segments := cattp.PathSegments(r, "/saved/")
+	switch {
+	case len(segments) == 1:
+		fileDetailHandle(w, r, context)
+	case len(segments) == 2 && segments[1] == "tags":
+		fileTagsHandle(w, r, context)
+	case len(segments) == 2 && segments[1] == "history":
+		fileHistoryHandle(w, r, context)
+	case len(segments) == 2 && segments[1] == "download":
+		fileDownloadHandle(w, r, context)
+	default:
+		defer r.Body.Close()
+		http.NotFound(w, r)
+	}
+})
+
+// Everything known about a file, flattened with its own fields
+type fileDetail struct {
+	*FileInfo
+	SourceLink    string         `json:"source_link,omitempty"`
+	Reposts       []*Repost      `json:"reposts"`
+	ReviewHistory []*ReviewEvent `json:"review_history"`
+}
+
+var fileDetailHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *http.Request, context *webapp) {
+	defer r.Body.Close()
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	session, err := context.sessions.Validate(context.db, r)
+	if err != nil {
+		log.Println("Invalid session")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(cattp.PathSegments(r, "/saved/")[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var file FileInfo
+	tx := context.gorm.Preload("Tags").Omit("Content").Limit(1).Find(&file, id)
+	if tx.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if tx.RowsAffected < 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	detail := fileDetail{FileInfo: &file, SourceLink: sourceLink(&file)}
+	err = context.gorm.Where("file_id = ?", id).Order("sent, id").Find(&detail.Reposts).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	detail.ReviewHistory, err = reviewHistory(context.gorm, id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	payload, err := json.Marshal(detail)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[%d][ID %v] Get Saved File %d\n", http.StatusOK, session.UserId, id)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(payload)
+})
+
+// Every decision taken on a file, oldest first
+var fileHistoryHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *http.Request, context *webapp) {
+	defer r.Body.Close()
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	session, err := context.sessions.Validate(context.db, r)
+	if err != nil {
+		log.Println("Invalid session")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(cattp.PathSegments(r, "/saved/")[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var count int64
+	err = context.gorm.Model(&FileInfo{}).Where("id = ?", id).Count(&count).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if count == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	history, err := reviewHistory(context.gorm, id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	payload, err := json.Marshal(history)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[%d][ID %v] Get Review History %d\n", http.StatusOK, session.UserId, id)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(payload)
+})
+
+// The original file as an attachment, with Range requests and
+// conditional requests on the content digest
+var fileDownloadHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *http.Request, context *webapp) {
+	defer r.Body.Close()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	_, err := context.sessions.Validate(context.db, r)
+	if err != nil {
+		log.Println("Invalid session")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(cattp.PathSegments(r, "/saved/")[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var file FileInfo
+	tx := context.gorm.Omit("Content").Limit(1).Find(&file, id)
+	if tx.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if tx.RowsAffected < 1 || file.Path == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	content, err := context.storage.Get(file.Path)
+	if errors.Is(err, storage.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+	// Ranges need seeking, remote backends are read in memory as
+	// files are bound by the ingestion size limit
+	seeker, ok := content.(io.ReadSeeker)
+	if !ok {
+		buffer, err := io.ReadAll(content)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		seeker = bytes.NewReader(buffer)
+	}
+
+	// ServeContent keeps the headers already set
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, file.Digest))
+	if file.MimeType != "" {
+		w.Header().Set("Content-Type", file.MimeType)
+	}
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": file.FileName})
+	if disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	modified := time.Time{}
+	if file.Sent != nil {
+		modified = *file.Sent
+	}
+	http.ServeContent(w, r, file.FileName, modified, seeker)
+})
+
+type tagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+type fileTagsPayload struct {
+	Tags          []Tag    `json:"tags"`
+	SuggestedTags []string `json:"suggested_tags"`
+}
+
+// Lists, adds and removes the tags of a file
+var fileTagsHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *http.Request, context *webapp) {
+	defer r.Body.Close()
+	session, err := context.sessions.Validate(context.db, r)
+	if err != nil {
+		log.Println("Invalid session")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(cattp.PathSegments(r, "/saved/")[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var file FileInfo
+	tx := context.gorm.Omit("Content").Limit(1).Find(&file, id)
+	if tx.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if tx.RowsAffected < 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		var request tagsRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || len(normalizeTags(request.Tags)) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPost {
+			err = addTags(context.gorm, []int{id}, request.Tags)
+		} else {
+			err = removeTags(context.gorm, []int{id}, request.Tags)
+		}
+		if err != nil {
+			log.Println("Error updating tags")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[%d] Updated tags of post %d\n", session.UserId, id)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	tags, err := fileTags(context.gorm, id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	payload, err := json.Marshal(fileTagsPayload{Tags: tags, SuggestedTags: file.SuggestedTags})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(payload)
+})
+
+var tagsHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *http.Request, context *webapp) {
+	defer r.Body.Close()
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	_, err := context.sessions.Validate(context.db, r)
+	if err != nil {
+		log.Println("Invalid session")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	counts, err := tagCounts(context.gorm)
+	if err != nil {
+		log.Println("Error counting tags")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	payload, err := json.Marshal(counts)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(payload)
+})
+
+type retagRequest struct {
+	IDs    []int    `json:"ids"`
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// Adds and removes tags on many files at once, removals first so a
+// tag can be replaced by another
+var retagHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *http.Request, context *webapp) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	session, err := context.sessions.Validate(context.db, r)
+	if err != nil {
+		log.Println("Invalid session")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var request retagRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || len(request.IDs) == 0 || len(request.Add)+len(request.Remove) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// Unknown IDs are skipped
+	var ids []int
+	tx := context.gorm.Model(&FileInfo{}).Where("id IN ?", request.IDs).Pluck("id", &ids)
+	if tx.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(ids) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = context.gorm.Transaction(func(tx *gorm.DB) error {
+		if err := removeTags(tx, ids, request.Remove); err != nil {
+			return err
+		}
+		return addTags(tx, ids, request.Add)
+	})
+	if err != nil {
+		log.Println("Error retagging files")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[%d] Retagged %d posts\n", session.UserId, len(ids))
+	w.WriteHeader(http.StatusOK)
+})
+
+var searchHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *http.Request, context *webapp) {
+	defer r.Body.Close()
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, err := context.sessions.Validate(context.db, r)
+	if err != nil {
+		log.Println("Invalid session")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query().Get("q")
+	if strings.TrimSpace(q) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	limit := searchDefaultLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > searchMaxLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	results, err := searchArchive(context.gorm, q, limit)
+	if err != nil {
+		log.Println("Error searching the archive")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	payload, err := json.Marshal(results)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[%d][ID %v] Searched %q, %d results\n", http.StatusOK, session.UserId, q, len(results))
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(payload)
+})
+
+var thumbHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *http.Request, context *webapp) {
+	defer r.Body.Close()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	segments := cattp.PathSegments(r, "/img/thumb/")
+	if len(segments) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.Atoi(segments[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var file FileInfo
+	tx := context.gorm.Omit("Content").Limit(1).Find(&file, id)
+	if tx.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if tx.RowsAffected < 1 || file.ThumbPath == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// The content behind an ID never changes
+	etag := fmt.Sprintf(`"%s"`, file.Digest)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	storage.ServeObject(w, r, context.storage, file.ThumbPath)
+})
+
 var profileHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *http.Request, context *webapp) {
 	defer r.Body.Close()
 
@@ -319,6 +999,138 @@ var profileHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *ht
 	w.Write(payload)
 })
 
+// Profile of the signed in user when they are an admin, otherwise
+// the error status is written and nil returned
+func (context *webapp) adminProfile(w http.ResponseWriter, r *http.Request) *profile {
+	session, err := context.sessions.Validate(context.db, r)
+	if err != nil {
+		log.Println("Invalid session")
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil
+	}
+	profile, err := userRead(context.db, session.UserId)
+	if err != nil || !profile.IsAdmin {
+		log.Printf("[%d] Not allowed to manage guilds\n", session.UserId)
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+	return profile
+}
+
+// Web app users review with their profile, admins can veto
+func (context *webapp) webReviewer(userID int) (reviewer, error) {
+	profile, err := userRead(context.db, userID)
+	if err != nil {
+		return reviewer{}, err
+	}
+	return reviewer{userID: userID, source: sourceWeb, admin: profile.IsAdmin}, nil
+}
+
+var guildsHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *http.Request, context *webapp) {
+	defer r.Body.Close()
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if context.adminProfile(w, r) == nil {
+		return
+	}
+
+	var guilds []*GuildConfig
+	tx := context.gorm.Order("guild_id").Find(&guilds)
+	if tx.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	payload, err := json.Marshal(guilds)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(payload)
+})
+
+// Reads, creates or replaces and removes the configuration of a
+// guild, changes are applied right away
+var guildHandle = cattp.HandlerFunc[*webapp](func(w http.ResponseWriter, r *http.Request, context *webapp) {
+	defer r.Body.Close()
+	segments := cattp.PathSegments(r, "/guilds/")
+	if len(segments) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+	guildID := segments[0]
+	admin := context.adminProfile(w, r)
+	if admin == nil {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var guild GuildConfig
+		tx := context.gorm.Limit(1).Find(&guild, "guild_id = ?", guildID)
+		if tx.Error != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if tx.RowsAffected < 1 {
+			http.NotFound(w, r)
+			return
+		}
+		payload, err := json.Marshal(guild)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(payload)
+		return
+
+	case http.MethodPut:
+		var guild GuildConfig
+		err := json.NewDecoder(r.Body).Decode(&guild)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		guild.GuildID = guildID
+		if err := guild.validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		tx := context.gorm.Save(&guild)
+		if tx.Error != nil {
+			log.Println("Error saving guild configuration")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[%d] Updated configuration of guild %s\n", admin.ID, guildID)
+
+	case http.MethodDelete:
+		tx := context.gorm.Delete(&GuildConfig{}, "guild_id = ?", guildID)
+		if tx.Error != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if tx.RowsAffected < 1 {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("[%d] Removed configuration of guild %s\n", admin.ID, guildID)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := context.guilds.load(context.gorm); err != nil {
+		log.Println("Error reloading guild configurations")
+	}
+	w.WriteHeader(http.StatusOK)
+})
+
 // func notFound(w http.ResponseWriter, r *http.Request) {
 // 	defer r.Body.Close()
 // 	http.NotFound(w, r)
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"memegrab/cattp"
+	"memegrab/sessions"
+	"memegrab/storage"
+)
+
+// A web app on the database and storage of the bot
+func newTestWebapp(t *testing.T, bot *memeBot) *webapp {
+	t.Helper()
+	sqlDB, err := bot.gorm.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &webapp{
+		sessions: sessions.New(time.Hour),
+		db:       sqlDB,
+		gorm:     bot.gorm,
+		storage:  bot.storage,
+		guilds:   bot.guilds,
+		review:   bot.conf.review,
+		onReview: func(int) {},
+	}
+}
+
+// Signs in a new user. Users and sessions aren't part of the
+// migrations, their tables are made here as far as the web app reads them.
+func signIn(t *testing.T, app *webapp, admin bool) *http.Cookie {
+	t.Helper()
+	statements := []string{
+		"CREATE SCHEMA IF NOT EXISTS users",
+		`CREATE TABLE IF NOT EXISTS users.all_users (id integer PRIMARY KEY, username text, email text,
+			display_name text, is_online boolean, last_login timestamptz, last_offline timestamptz, is_admin boolean)`,
+		"CREATE SCHEMA IF NOT EXISTS http",
+		"CREATE TABLE IF NOT EXISTS http.sessions (id integer PRIMARY KEY, token text, created timestamptz, expiry timestamptz)",
+	}
+	for _, statement := range statements {
+		if _, err := app.db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id := int(time.Now().UnixNano() % 1000000000)
+	name := fmt.Sprintf("user%d", id)
+	_, err := app.db.Exec(
+		"INSERT INTO users.all_users VALUES ($1, $2, $3, $2, false, now(), now(), $4)",
+		id, name, name+"@example.com", admin,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		app.db.Exec("DELETE FROM http.sessions WHERE id = $1", id)
+		app.db.Exec("DELETE FROM users.all_users WHERE id = $1", id)
+	})
+
+	token := "token-" + name
+	if app.sessions.Create(app.db, token, id, time.Time{}) == nil {
+		t.Fatal("session not created")
+	}
+	return &http.Cookie{Name: "memegrab", Value: token}
+}
+
+// Runs the handler on a request, with the session cookie when given
+func serveTest(handler cattp.HandlerFunc[*webapp], app *webapp, r *http.Request, cookie *http.Cookie) *httptest.ResponseRecorder {
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r, app)
+	return w
+}
+
+func jsonRequest(t *testing.T, method string, target string, body interface{}) *http.Request {
+	t.Helper()
+	payload, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewRequest(method, target, bytes.NewReader(payload))
+}
+
+func TestRetagHandle(t *testing.T) {
+	bot, _ := newTestBot(t)
+	app := newTestWebapp(t, bot)
+	cookie := signIn(t, app, false)
+	files := createPending(t, bot.gorm, 3)
+	for _, file := range files {
+		if err := addTags(bot.gorm, []int{file.ID}, []string{"old", "cat"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Unknown IDs are skipped, the old tag replaced on the others
+	request := retagRequest{IDs: []int{files[0].ID, files[1].ID, 999999}, Add: []string{"New Tag"}, Remove: []string{"#Old"}}
+	w := serveTest(retagHandle, app, jsonRequest(t, http.MethodPost, "/mod/tags", request), cookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	for i, want := range []string{"[cat new-tag]", "[cat new-tag]", "[cat old]"} {
+		tags, err := fileTags(bot.gorm, files[i].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, tag := range tags {
+			names = append(names, tag.Name)
+		}
+		if got := fmt.Sprint(names); got != want {
+			t.Errorf("file %d tagged %s, want %s", i, got, want)
+		}
+	}
+	// The search sees the new tags
+	var ids []int
+	withTags(bot.gorm.Model(&FileInfo{}), []string{"new-tag"}).Order("id").Pluck("id", &ids)
+	if fmt.Sprint(ids) != fmt.Sprint(fileIDs(files[:2])) {
+		t.Errorf("got files %v tagged new-tag", ids)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		body   interface{}
+		signed bool
+		status int
+	}{
+		{name: "signed out", method: http.MethodPost, body: request, status: http.StatusUnauthorized},
+		{name: "not a post", method: http.MethodGet, body: request, signed: true, status: http.StatusMethodNotAllowed},
+		{name: "no files", method: http.MethodPost, body: retagRequest{Add: []string{"cat"}}, signed: true, status: http.StatusBadRequest},
+		{name: "no tags", method: http.MethodPost, body: retagRequest{IDs: []int{files[0].ID}}, signed: true, status: http.StatusBadRequest},
+		{name: "unknown files", method: http.MethodPost, body: retagRequest{IDs: []int{999999}, Add: []string{"cat"}}, signed: true, status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var withCookie *http.Cookie
+			if test.signed {
+				withCookie = cookie
+			}
+			w := serveTest(retagHandle, app, jsonRequest(t, test.method, "/mod/tags", test.body), withCookie)
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
+
+// A stored file, served like the remote backends do
+type streamOnly struct{ storage.Storage }
+
+func (s streamOnly) Get(name string) (io.ReadCloser, error) {
+	content, err := s.Storage.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	buffer, err := io.ReadAll(content)
+	return io.NopCloser(bytes.NewReader(buffer)), err
+}
+
+func TestFileDownloadHandle(t *testing.T) {
+	bot, _ := newTestBot(t)
+	app := newTestWebapp(t, bot)
+	cookie := signIn(t, app, false)
+
+	content := testPNG(1)
+	file := testFile("4001", "cat meme.png", content)
+	file.Path = blobPath(file.Digest, file.FileName)
+	if err := bot.storage.Put(file.Path, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	// Known, but missing from the storage
+	lost := testFile("4002", "lost.png", testPNG(2))
+	lost.Path = blobPath(lost.Digest, lost.FileName)
+	for _, f := range []*FileInfo{file, lost} {
+		if err := bot.gorm.Omit("Content").Create(f).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	target := fmt.Sprintf("/saved/%d/download", file.ID)
+	etag := fmt.Sprintf(`"%s"`, file.Digest)
+
+	for name, store := range map[string]storage.Storage{"local": bot.storage, "stream": streamOnly{bot.storage}} {
+		t.Run(name, func(t *testing.T) {
+			app.storage = store
+
+			w := serveTest(savedFileHandle, app, httptest.NewRequest(http.MethodGet, target, nil), cookie)
+			if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+				t.Fatalf("got status %d with %d bytes", w.Code, w.Body.Len())
+			}
+			headers := map[string]string{
+				"Content-Disposition": `attachment; filename="cat meme.png"`,
+				"Content-Type":        "image/png",
+				"Content-Length":      fmt.Sprint(len(content)),
+				"ETag":                etag,
+				"Accept-Ranges":       "bytes",
+			}
+			for header, want := range headers {
+				if got := w.Header().Get(header); got != want {
+					t.Errorf("got %s %q, want %q", header, got, want)
+				}
+			}
+
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			r.Header.Set("If-None-Match", etag)
+			if w := serveTest(savedFileHandle, app, r, cookie); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+				t.Errorf("got status %d with %d bytes for a cached file", w.Code, w.Body.Len())
+			}
+			r = httptest.NewRequest(http.MethodGet, target, nil)
+			r.Header.Set("If-None-Match", `"other"`)
+			if w := serveTest(savedFileHandle, app, r, cookie); w.Code != http.StatusOK {
+				t.Errorf("got status %d for a changed file", w.Code)
+			}
+
+			r = httptest.NewRequest(http.MethodGet, target, nil)
+			r.Header.Set("Range", "bytes=10-19")
+			w = serveTest(savedFileHandle, app, r, cookie)
+			if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), content[10:20]) {
+				t.Errorf("got status %d with %q for a range", w.Code, w.Body.Bytes())
+			}
+			if got, want := w.Header().Get("Content-Range"), fmt.Sprintf("bytes 10-19/%d", len(content)); got != want {
+				t.Errorf("got Content-Range %q, want %q", got, want)
+			}
+			r = httptest.NewRequest(http.MethodGet, target, nil)
+			r.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(content)+10))
+			if w := serveTest(savedFileHandle, app, r, cookie); w.Code != http.StatusRequestedRangeNotSatisfiable {
+				t.Errorf("got status %d for a range past the end", w.Code)
+			}
+
+			w = serveTest(savedFileHandle, app, httptest.NewRequest(http.MethodHead, target, nil), cookie)
+			if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Content-Length") != fmt.Sprint(len(content)) {
+				t.Errorf("got status %d with %d bytes for a HEAD", w.Code, w.Body.Len())
+			}
+		})
+	}
+	app.storage = bot.storage
+
+	// Names outside of ASCII are encoded
+	bot.gorm.Model(file).Update("file_name", "café.png")
+	w := serveTest(savedFileHandle, app, httptest.NewRequest(http.MethodGet, target, nil), cookie)
+	if got, want := w.Header().Get("Content-Disposition"), `attachment; filename*=utf-8''caf%C3%A9.png`; got != want {
+		t.Errorf("got Content-Disposition %q, want %q", got, want)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		signed bool
+		status int
+	}{
+		{name: "signed out", method: http.MethodGet, target: target, status: http.StatusUnauthorized},
+		{name: "not a get", method: http.MethodPost, target: target, signed: true, status: http.StatusMethodNotAllowed},
+		{name: "unknown file", method: http.MethodGet, target: "/saved/999999/download", signed: true, status: http.StatusNotFound},
+		{name: "not an id", method: http.MethodGet, target: "/saved/cat/download", signed: true, status: http.StatusNotFound},
+		{name: "missing from the storage", method: http.MethodGet, target: fmt.Sprintf("/saved/%d/download", lost.ID), signed: true, status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var withCookie *http.Cookie
+			if test.signed {
+				withCookie = cookie
+			}
+			w := serveTest(savedFileHandle, app, httptest.NewRequest(test.method, test.target, nil), withCookie)
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestGuildHandle(t *testing.T) {
+	bot, fake := newTestBot(t)
+	bot.guilds.onLoad = bot.registerCommands
+	app := newTestWebapp(t, bot)
+	admin := signIn(t, app, true)
+
+	target := "/guilds/20"
+	config := GuildConfig{ObservedChannels: []string{"2000"}, ShowcaseChannel: "2001", ShowcaseSchedule: "0 9 * * *"}
+	w := serveTest(guildHandle, app, jsonRequest(t, http.MethodPut, target, config), admin)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	if guild := bot.guilds.forChannel("2000"); guild == nil || guild.GuildID != "20" {
+		t.Errorf("configuration not applied: %+v", guild)
+	}
+	// Registered after the response
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fake.mu.Lock()
+		commands := fake.Commands["20"]
+		fake.mu.Unlock()
+		if len(commands) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("commands not registered on the new guild")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	config.ShowcaseSchedule = "every day"
+	w = serveTest(guildHandle, app, jsonRequest(t, http.MethodPut, target, config), admin)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for an invalid schedule", w.Code)
+	}
+	if guild := bot.guilds.forGuild("20"); guild.ShowcaseSchedule != "0 9 * * *" {
+		t.Errorf("invalid schedule applied: %q", guild.ShowcaseSchedule)
+	}
+
+	moderator := signIn(t, app, false)
+	if w := serveTest(guildHandle, app, httptest.NewRequest(http.MethodDelete, target, nil), moderator); w.Code != http.StatusForbidden {
+		t.Errorf("got status %d removing a guild as a moderator", w.Code)
+	}
+	if w := serveTest(guildHandle, app, httptest.NewRequest(http.MethodDelete, target, nil), admin); w.Code != http.StatusOK {
+		t.Errorf("got status %d removing a guild", w.Code)
+	}
+	if bot.guilds.forChannel("2000") != nil {
+		t.Error("removed guild still observed")
+	}
+}